@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// walletJSON is the API representation of an Address
+type walletJSON struct {
+	Name      string            `json:"name"`
+	Address   string            `json:"address"`
+	ENS       string            `json:"ens,omitempty"`
+	ENSExpiry *time.Time        `json:"ensExpiry,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Balances  []balanceJSON     `json:"balances"`
+}
+
+// balanceJSON is the API representation of a Balance, Balance is the exact decimal amount
+type balanceJSON struct {
+	Symbol      string     `json:"symbol"`
+	Balance     string     `json:"balance,omitempty"`
+	Raw         string     `json:"raw,omitempty"`
+	Token       *TokenData `json:"token,omitempty"`
+	Block       uint64     `json:"block,omitempty"`
+	Status      string     `json:"status"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	Errors      uint64     `json:"errors"`
+}
+
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/wallets", handleWallets)
+	mux.HandleFunc("GET /api/v1/wallets/{address}", handleWallet)
+	mux.HandleFunc("GET /api/v1/wallets/{address}/history", handleHistory)
+	mux.HandleFunc("GET /api/v1/wallets/{address}/gas", handleGas)
+	mux.HandleFunc("GET /api/v1/tokens", handleTokens)
+	mux.HandleFunc("GET /api/v1/export", handleExport)
+}
+
+func handleWallets(w http.ResponseWriter, r *http.Request) {
+	list := watchedAddresses()
+	wallets := make([]walletJSON, 0, len(list))
+	for _, v := range list {
+		wallets = append(wallets, toWalletJSON(v))
+	}
+	writeJSON(w, http.StatusOK, wallets)
+}
+
+func handleWallet(w http.ResponseWriter, r *http.Request) {
+	v, ok := findAddress(r.PathValue("address"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "wallet not watched"})
+		return
+	}
+	writeJSON(w, http.StatusOK, toWalletJSON(v))
+}
+
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentTokens())
+}
+
+// findAddress looks up a watched wallet by hex address, ENS name or name
+func findAddress(key string) (Address, bool) {
+	for _, v := range watchedAddresses() {
+		if (common.IsHexAddress(key) && common.HexToAddress(key) == v.address) ||
+			strings.EqualFold(key, v.name) || (v.ens != "" && strings.EqualFold(key, v.ens)) {
+			return v, true
+		}
+	}
+	return Address{}, false
+}
+
+func toWalletJSON(v Address) walletJSON {
+	wallet := walletJSON{Name: v.name, Address: v.address.Hex(), ENS: v.ens, Labels: v.labels, Balances: make([]balanceJSON, 0, len(v.balances))}
+	if !v.ensExpiry.IsZero() {
+		expiry := v.ensExpiry
+		wallet.ENSExpiry = &expiry
+	}
+	for _, b := range v.balances {
+		wallet.Balances = append(wallet.Balances, toBalanceJSON(b))
+	}
+	return wallet
+}
+
+func toBalanceJSON(b Balance) balanceJSON {
+	balance := balanceJSON{Symbol: b.symbol, Balance: b.exact(), Block: b.block, Status: b.status(), Errors: b.errors}
+	if b.amount != nil {
+		balance.Raw = b.amount.String()
+	}
+	if (b.token != TokenData{}) {
+		token := b.token
+		balance.Token = &token
+	}
+	if !b.lastSuccess.IsZero() {
+		lastSuccess := b.lastSuccess
+		balance.LastSuccess = &lastSuccess
+	}
+	return balance
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Could not write JSON response: %s", err)
+	}
+}
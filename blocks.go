@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const blocksCheckpoint = "blocks"
+
+// rpcBlock is the part of eth_getBlockByNumber (with transactions) the block scanner uses.
+// Blocks are decoded by hand as the bundled go-ethereum can't decode newer transaction types
+type rpcBlock struct {
+	Number       hexutil.Uint64   `json:"number"`
+	Hash         common.Hash      `json:"hash"`
+	Timestamp    hexutil.Uint64   `json:"timestamp"`
+	BaseFee      *hexutil.Big     `json:"baseFeePerGas"`
+	Transactions []rpcTransaction `json:"transactions"`
+
+	// receipts caches the receipts fetched for this block, more than one scan may need the same one
+	receipts map[common.Hash]*rpcReceipt
+}
+
+type rpcTransaction struct {
+	Hash  common.Hash     `json:"hash"`
+	From  common.Address  `json:"from"`
+	To    *common.Address `json:"to"`
+	Value *hexutil.Big    `json:"value"`
+}
+
+type rpcReceipt struct {
+	Status            hexutil.Uint64  `json:"status"`
+	GasUsed           hexutil.Uint64  `json:"gasUsed"`
+	EffectiveGasPrice *hexutil.Big    `json:"effectiveGasPrice"`
+	BlobGasUsed       *hexutil.Uint64 `json:"blobGasUsed"`
+	BlobGasPrice      *hexutil.Big    `json:"blobGasPrice"`
+}
+
+// blockLoop processes every new block once, continuing from the last checkpoint so nothing is counted twice across restarts
+func blockLoop(ctx context.Context) {
+	next, ok := loadCheckpoint(blocksCheckpoint)
+	if ok {
+		next++
+	} else {
+		next = scanStartBlock
+	}
+	ticker := time.NewTicker(refreshDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var head uint64
+		err := client.call(ctx, "eth_blockNumber", func(c *ethclient.Client) (err error) {
+			head, err = c.BlockNumber(ctx)
+			return err
+		})
+		if err != nil {
+			log.Errorf("Block scanner could not get head: %s", err)
+			continue
+		}
+		if head < scanConfirmations {
+			continue
+		}
+		head -= scanConfirmations
+		if next == 0 {
+			//nothing to continue from, only count from now on
+			next = head
+		}
+		for next <= head {
+			to := next + scanBatch - 1
+			if to > head {
+				to = head
+			}
+			start := time.Now()
+			if err := scanBlocks(ctx, next, to); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Errorf("Could not scan blocks %d-%d, retrying: %s", next, to, err)
+				break
+			}
+			scanDuration.observe(newLabels("scan", "blocks"), time.Since(start).Seconds())
+			log.Debugf("Scanned blocks %d-%d (%s)", next, to, time.Since(start))
+			saveBlocksCheckpoint(to)
+			next = to + 1
+		}
+	}
+}
+
+// saveBlocksCheckpoint records the last block scanned in the same transaction as the gas summaries it changed, so a crash can't count them twice
+func saveBlocksCheckpoint(block uint64) {
+	if state == nil {
+		return
+	}
+	gasDaysMu.Lock()
+	defer gasDaysMu.Unlock()
+	err := state.Update(func(tx *bolt.Tx) error {
+		if err := putGasDays(tx); err != nil {
+			return err
+		}
+		return putCheckpoint(tx, blocksCheckpoint, block)
+	})
+	if err != nil {
+		//the summaries stay dirty, they're saved with the next checkpoint
+		log.Errorf("Could not save checkpoint (%s): %s", blocksCheckpoint, err)
+		return
+	}
+	gasDaysDirty = map[gasDayKey]bool{}
+}
+
+// scanBlocks processes blocks from to to (inclusive), only applying what was found if the whole range succeeded
+func scanBlocks(ctx context.Context, from, to uint64) (err error) {
+	ctx, span := tracer.Start(ctx, "scan blocks", trace.WithAttributes(attribute.Int64("from", int64(from)), attribute.Int64("to", int64(to))))
+	defer func() { endSpan(span, err) }()
+	list := watchedAddresses()
+	watched := make(map[common.Address]Address, len(list))
+	for _, v := range list {
+		watched[v.address] = v
+	}
+	var found []transfer
+	var spent []gasSpend
+	if transfers {
+		tokens, err := scanTokenTransfers(ctx, watched, from, to)
+		if err != nil {
+			return err
+		}
+		found = tokens
+	}
+	for n := from; n <= to; n++ {
+		block, err := getBlock(ctx, n)
+		if err != nil {
+			return err
+		}
+		if transfers {
+			native, err := scanNativeTransfers(ctx, watched, block)
+			if err != nil {
+				return err
+			}
+			found = append(found, native...)
+		}
+		if transfers && traceAPI != "" {
+			internal, err := scanInternalTransfers(ctx, watched, n)
+			if err != nil {
+				return err
+			}
+			found = append(found, internal...)
+		}
+		if gasSpending {
+			gas, err := scanGasSpend(ctx, watched, block)
+			if err != nil {
+				return err
+			}
+			spent = append(spent, gas...)
+		}
+	}
+	for _, t := range found {
+		t.count()
+	}
+	for _, g := range spent {
+		g.count()
+	}
+	return nil
+}
+
+func getBlock(ctx context.Context, number uint64) (*rpcBlock, error) {
+	var block *rpcBlock
+	err := client.rawCall(ctx, &block, "eth_getBlockByNumber", hexutil.EncodeUint64(number), true)
+	if err == nil && block == nil {
+		err = fmt.Errorf("block %d not found", number)
+	}
+	return block, err
+}
+
+func (b *rpcBlock) receipt(ctx context.Context, hash common.Hash) (*rpcReceipt, error) {
+	if receipt, ok := b.receipts[hash]; ok {
+		return receipt, nil
+	}
+	var receipt *rpcReceipt
+	err := client.rawCall(ctx, &receipt, "eth_getTransactionReceipt", hash)
+	if err == nil && receipt == nil {
+		err = fmt.Errorf("receipt of %s not found", hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.receipts == nil {
+		b.receipts = map[common.Hash]*rpcReceipt{}
+	}
+	b.receipts[hash] = receipt
+	return receipt, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+)
+
+// command is a one-shot subcommand run instead of the exporter, watched meaning it needs the watched addresses loaded and tokens that it is wrong without the token list
+type command struct {
+	usage   string
+	summary string
+	minArgs int
+	maxArgs int
+	watched bool
+	tokens  bool
+	run     func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"balance":  {usage: "balance <address|ens>", summary: "Print every non-zero balance of an address, ENS name or extended public key", minArgs: 1, maxArgs: 1, tokens: true, run: runBalance},
+	"tokens":   {usage: "tokens [search]", summary: "List the token list, only tokens whose symbol, name or address contain search if given", maxArgs: 1, tokens: true, run: runTokens},
+	"resolve":  {usage: "resolve <ens>", summary: "Resolve an ENS name to its address", minArgs: 1, maxArgs: 1, run: runResolve},
+	"reverse":  {usage: "reverse <address>", summary: "Look up the verified primary ENS name of an address", minArgs: 1, maxArgs: 1, run: runReverse},
+	"check":    {usage: "check", summary: "Check the configuration and that every geth endpoint responds", run: runCheck},
+	"snapshot": {usage: "snapshot [block|time]", summary: "Write every balance of the watched addresses at a block or RFC3339 time (latest by default) as --format to --output", maxArgs: 1, watched: true, tokens: true, run: runSnapshot},
+}
+
+// printUsage lists the subcommands along with the flags
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\nWithout a command the exporter is run, otherwise the command is run once:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 3, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", commands[name].usage, commands[name].summary)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nFlags:\n%s", flag.CommandLine.FlagUsages())
+}
+
+// checkCommand exits on help or an unknown command before anything is set up for it
+func checkCommand() {
+	name := flag.Arg(0)
+	if name == "" {
+		return
+	}
+	if name == "help" {
+		printUsage()
+		os.Exit(0)
+	}
+	c, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage()
+		os.Exit(2)
+	}
+	if args := flag.NArg() - 1; args < c.minArgs || args > c.maxArgs {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] %s\n", os.Args[0], c.usage)
+		os.Exit(2)
+	}
+}
+
+// runCommand runs the subcommand given on the command line, exiting non-zero if it fails
+func runCommand(ctx context.Context) {
+	name := flag.Arg(0)
+	if err := importTokenList(ctx); err != nil {
+		//only ETH would be printed, which looks like a wallet holding no tokens
+		if commands[name].tokens {
+			log.Fatalf("Could not run %s without the token list: %s", name, err)
+		}
+		log.Errorf("Could not get token list: %s", err)
+	}
+	if commands[name].watched {
+		loadWatched(ctx)
+	}
+	if err := commands[name].run(ctx, flag.Args()[1:]); err != nil {
+		log.Fatalf("Could not run %s: %s", name, err)
+	}
+}
+
+// printResult writes v as JSON with --json, otherwise rows as a table under headers
+func printResult(headers []string, rows [][]string, v interface{}) error {
+	if printJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+type cliBalance struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Symbol  string `json:"symbol"`
+	Token   string `json:"token,omitempty"`
+	Balance string `json:"balance"`
+}
+
+func runBalance(ctx context.Context, args []string) error {
+	addresses := parseAddresses(ctx, args)
+	if len(addresses) == 0 {
+		return fmt.Errorf("%s is not a hex address, ENS name or extended public key", args[0])
+	}
+	balances := []cliBalance{}
+	var rows [][]string
+	var incomplete []string
+	for _, v := range addresses {
+		result := probe(ctx, v.address.Hex(), nil)
+		if !result.success {
+			incomplete = append(incomplete, fmt.Sprintf("%s (%s)", v.address.Hex(), strings.Join(result.failed, ", ")))
+		}
+		for _, b := range result.balances {
+			if b.amount == nil || b.amount.Sign() == 0 {
+				continue
+			}
+			row := cliBalance{Name: v.name, Address: v.address.Hex(), Symbol: b.symbol, Balance: b.exact()}
+			if (b.token != TokenData{}) {
+				row.Token = b.token.realAddress.Hex()
+			}
+			balances = append(balances, row)
+			rows = append(rows, []string{row.Name, row.Address, row.Symbol, row.Balance, row.Token})
+		}
+	}
+	if err := printResult([]string{"NAME", "ADDRESS", "SYMBOL", "BALANCE", "TOKEN"}, rows, balances); err != nil {
+		return err
+	}
+	if len(incomplete) > 0 {
+		return fmt.Errorf("some balances could not be looked up: %s", strings.Join(incomplete, "; "))
+	}
+	return nil
+}
+
+func runTokens(_ context.Context, args []string) error {
+	search := ""
+	if len(args) > 0 {
+		search = strings.ToLower(args[0])
+	}
+	list := currentTokens()
+	tokens := []TokenData{}
+	var rows [][]string
+	for _, t := range list {
+		if search != "" && !strings.Contains(strings.ToLower(t.Symbol), search) && !strings.Contains(strings.ToLower(t.Name), search) && !strings.Contains(strings.ToLower(t.Address), search) {
+			continue
+		}
+		tokens = append(tokens, t)
+		rows = append(rows, []string{t.Symbol, t.Name, t.realAddress.Hex(), fmt.Sprint(t.Decimals)})
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("the token list could not be loaded")
+	}
+	return printResult([]string{"SYMBOL", "NAME", "ADDRESS", "DECIMALS"}, rows, tokens)
+}
+
+type cliName struct {
+	Name    string     `json:"name"`
+	Address string     `json:"address"`
+	Expiry  *time.Time `json:"expiry,omitempty"`
+}
+
+func printName(v Address) error {
+	name := cliName{Name: v.ens, Address: v.address.Hex()}
+	expiry := ""
+	if !v.ensExpiry.IsZero() {
+		name.Expiry = &v.ensExpiry
+		expiry = v.ensExpiry.UTC().Format(time.RFC3339)
+	}
+	return printResult([]string{"NAME", "ADDRESS", "EXPIRY"}, [][]string{{name.Name, name.Address, expiry}}, name)
+}
+
+func runResolve(ctx context.Context, args []string) error {
+	if common.IsHexAddress(args[0]) || isExtendedKey(args[0]) {
+		return fmt.Errorf("%s is not an ENS name, use reverse to look up the name of an address", args[0])
+	}
+	addresses := parseAddresses(ctx, args)
+	if len(addresses) == 0 {
+		return fmt.Errorf("%s could not be resolved", args[0])
+	}
+	return printName(addresses[0])
+}
+
+func runReverse(ctx context.Context, args []string) error {
+	if !common.IsHexAddress(args[0]) {
+		return fmt.Errorf("%s is not a hex address", args[0])
+	}
+	addresses := parseAddresses(ctx, args)
+	if len(addresses) == 0 || addresses[0].ens == "" {
+		return fmt.Errorf("%s has no verified primary ENS name", args[0])
+	}
+	return printName(addresses[0])
+}
+
+type cliCheck struct {
+	Check  string `json:"check"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// runCheck checks everything the exporter needs at startup, failing if any of it is broken
+func runCheck(ctx context.Context, _ []string) error {
+	var checks []cliCheck
+	add := func(check string, err error, detail string) {
+		if err != nil {
+			detail = err.Error()
+		}
+		checks = append(checks, cliCheck{Check: check, OK: err == nil, Detail: detail})
+	}
+
+	client.checkHealth(ctx)
+	for _, s := range client.status() {
+		if s.Up {
+			add("geth "+s.Label, nil, fmt.Sprintf("responding in %s", s.Latency))
+		} else {
+			add("geth "+s.Label, fmt.Errorf("not responding"), "")
+		}
+	}
+	tokens := currentTokens()
+	if len(tokens) == 0 {
+		add("token list", fmt.Errorf("could not be loaded"), "")
+	} else {
+		add("token list", nil, fmt.Sprintf("%d tokens", len(tokens)))
+	}
+	for _, input := range rawAddresses {
+		switch {
+		case isExtendedKey(input):
+			_, _, err := parseDerivation(input)
+			//never print the whole input, it could be a private key
+			add("address "+input[:min(len(input), 12)]+"...", err, "valid extended public key")
+		case common.IsHexAddress(input):
+			add("address "+input, nil, "valid hex address")
+		default:
+			address, err := resolveENS(ctx, input)
+			add("address "+input, err, "resolves to "+address.Hex())
+		}
+	}
+	if hasAddressSources() {
+		entries, err := readAddressSources(ctx)
+		add("address sources", err, fmt.Sprintf("%d addresses", len(entries)))
+	}
+	if topUpKeyPath != "" {
+		key, err := crypto.LoadECDSA(topUpKeyPath)
+		detail := ""
+		if err == nil {
+			detail = "funding wallet " + crypto.PubkeyToAddress(key.PublicKey).Hex()
+			_, err = parseTopUpRules(topUpAmounts, topUpCaps, tokens)
+		}
+		add("top up key", err, detail)
+	}
+
+	failed := 0
+	rows := make([][]string, 0, len(checks))
+	for _, c := range checks {
+		status := "ok"
+		if !c.OK {
+			status = "FAIL"
+			failed++
+		}
+		rows = append(rows, []string{c.Check, status, c.Detail})
+	}
+	if err := printResult([]string{"CHECK", "STATUS", "DETAIL"}, rows, checks); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
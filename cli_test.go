@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBalanceFailsOnTokenError(t *testing.T) {
+	withTokenNode(t, []TokenData{probeUSDC, probeDAI}, probeDAI.realAddress)
+
+	err := runBalance(context.Background(), []string{probeWallet.Hex()})
+	if err == nil {
+		t.Fatal("balance succeeded with the DAI lookup failing")
+	}
+	if !strings.Contains(err.Error(), probeWallet.Hex()+" (DAI)") {
+		t.Errorf("error %q doesn't name the incomplete lookup", err)
+	}
+}
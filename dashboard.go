@@ -0,0 +1,56 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+var dashboard = template.Must(template.ParseFS(webFiles, "web/index.html"))
+
+// dashboardData is everything rendered on the status page
+type dashboardData struct {
+	RefreshSeconds int
+	LastRefresh    time.Time
+	LoadTime       time.Duration
+	Block          uint64
+	Tokens         []TokenData
+	Endpoints      []endpointStatus
+	Wallets        []walletJSON
+}
+
+func registerDashboard(mux *http.ServeMux) {
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		log.Panic(err)
+	}
+	mux.Handle("GET /static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("GET /{$}", handleDashboard)
+}
+
+// handleDashboard renders a quick overview of every watched wallet for operators
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	refresh := lastPublished()
+	data := dashboardData{
+		RefreshSeconds: int(refreshDuration.Seconds()),
+		LastRefresh:    refresh.at,
+		LoadTime:       refresh.took.Round(time.Millisecond),
+		Block:          refresh.block,
+		Tokens:         currentTokens(),
+		Endpoints:      client.status(),
+	}
+	for _, v := range refresh.addresses {
+		data.Wallets = append(data.Wallets, toWalletJSON(v))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboard.Execute(w, data); err != nil {
+		log.Errorf("Could not render dashboard: %s", err)
+	}
+}
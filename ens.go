@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	ens "github.com/wealdtech/go-ens/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ensBackend hands the context of a lookup to go-ens, which makes its calls without one, so they are cancelled with the lookup
+type ensBackend struct {
+	*ethclient.Client
+	ctx context.Context
+}
+
+func (b ensBackend) CallContract(_ context.Context, call ethereum.CallMsg, block *big.Int) ([]byte, error) {
+	return b.Client.CallContract(b.ctx, call, block)
+}
+
+func (b ensBackend) CodeAt(_ context.Context, account common.Address, block *big.Int) ([]byte, error) {
+	return b.Client.CodeAt(b.ctx, account, block)
+}
+
+// resolveENS resolves an ENS name to its address
+func resolveENS(ctx context.Context, name string) (address common.Address, err error) {
+	ctx, span := tracer.Start(ctx, "ENS resolve", trace.WithAttributes(attribute.String("ens.name", name)))
+	defer func() { endSpan(span, err) }()
+	err = client.call(ctx, "ens_resolve", func(c *ethclient.Client) error {
+		address, err = ens.Resolve(ensBackend{c, ctx}, name)
+		return err
+	})
+	return address, err
+}
+
+// errNoPrimaryName is returned by reverseResolve when the address has no primary name that forward resolves back to it,
+// as opposed to the lookup failing
+var errNoPrimaryName = errors.New("no verified primary name")
+
+// ensMissing says if a go-ens error means the record isn't set, rather than the lookup failing
+func ensMissing(err error) bool {
+	switch err.Error() {
+	case "no resolution", "not a resolver", "unregistered name", "no resolver", "no address":
+		return true
+	}
+	return false
+}
+
+// reverseResolve looks up the primary ENS name of an address, only trusting it if the name forward resolves back to the same address
+func reverseResolve(ctx context.Context, address common.Address) (name string, err error) {
+	ctx, span := tracer.Start(ctx, "ENS reverse resolve", trace.WithAttributes(attribute.String("address", address.Hex())))
+	defer func() { endSpan(span, err) }()
+	err = client.call(ctx, "ens_reverse", func(c *ethclient.Client) (err error) {
+		name, err = ens.ReverseResolve(ensBackend{c, ctx}, address)
+		return err
+	})
+	if err != nil {
+		if ensMissing(err) {
+			return "", fmt.Errorf("%w: %s", errNoPrimaryName, err)
+		}
+		return "", err
+	}
+	forward, err := resolveENS(ctx, name)
+	if err != nil {
+		if ensMissing(err) {
+			return "", fmt.Errorf("%w: reverse record %s doesn't resolve: %s", errNoPrimaryName, name, err)
+		}
+		return "", fmt.Errorf("could not forward resolve reverse record %s: %w", name, err)
+	}
+	if forward != address {
+		return "", fmt.Errorf("%w: reverse record %s resolves to %s not %s", errNoPrimaryName, name, forward, address)
+	}
+	return name, nil
+}
+
+// ensExpiry gets the registration expiry of the .eth second level domain that owns name (subdomains don't expire on their own)
+func ensExpiry(ctx context.Context, name string) (time.Time, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) < 2 || parts[len(parts)-1] != "eth" {
+		return time.Time{}, fmt.Errorf("%s is not a .eth name", name)
+	}
+	var expiry time.Time
+	err := client.call(ctx, "ens_expiry", func(c *ethclient.Client) error {
+		ensName, err := ens.NewName(ensBackend{c, ctx}, strings.Join(parts[len(parts)-2:], "."))
+		if err != nil {
+			return err
+		}
+		expiry, err = ensName.Expires()
+		return err
+	})
+	return expiry, err
+}
+
+// refreshENS re-resolves every address with an ENS name, so changes in the records are picked up without a restart
+func refreshENS(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "refresh ENS")
+	defer span.End()
+	start := time.Now()
+	for i, v := range addressList {
+		if isExtendedKey(v.input) {
+			//derived addresses aren't looked up in ENS
+			continue
+		}
+		if common.IsHexAddress(v.input) {
+			name, err := reverseResolve(ctx, v.address)
+			if err != nil && !errors.Is(err, errNoPrimaryName) {
+				log.Errorf("Could not re-resolve ENS of address (%s), keeping (%s): %s", v.address, v.name, err)
+				continue
+			}
+			if err != nil {
+				if v.ens != "" {
+					log.Warnf("ENS (%s) no longer verified for address (%s): %s", v.ens, v.address, err)
+				}
+				addressList[i].ens = ""
+				addressList[i].name = v.input
+				addressList[i].ensExpiry = time.Time{}
+				continue
+			}
+			if name != v.ens {
+				log.Infof("Found ENS (%s) for address (%s)", name, v.address)
+			}
+			addressList[i].ens = name
+			addressList[i].name = name
+		} else {
+			address, err := resolveENS(ctx, v.input)
+			if err != nil {
+				log.Errorf("Could not re-resolve ENS (%s), keeping address (%s): %s", v.input, v.address, err)
+				continue
+			}
+			if address != v.address {
+				log.Warnf("ENS (%s) changed from (%s) to (%s)", v.input, v.address, address)
+				addressList[i].address = address
+				//balances belong to the old address, scan the new one now rather than exporting nothing until the next full refresh
+				addressList[i].balances = nil
+				addressList[i].scanned = false
+				scanAddress(ctx, i)
+			}
+		}
+		addressList[i].ensExpiry = lookupENSExpiry(ctx, addressList[i].ens)
+	}
+	log.Infof("Refreshed ENS records for %d addresses (%s)", len(addressList), time.Since(start))
+}
+
+// lookupENSExpiry wraps ensExpiry, logging and returning the zero time on failure
+func lookupENSExpiry(ctx context.Context, name string) time.Time {
+	if name == "" {
+		return time.Time{}
+	}
+	expiry, err := ensExpiry(ctx, name)
+	if err != nil {
+		log.Debugf("Could not get ENS expiry for (%s): %s", name, err)
+		return time.Time{}
+	}
+	return expiry
+}
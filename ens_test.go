@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	ensResolver = common.HexToAddress("0xeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeeee")
+	ensOld      = common.HexToAddress("0x5555555555555555555555555555555555555555")
+	ensNew      = common.HexToAddress("0x7777777777777777777777777777777777777777")
+)
+
+// ensStandIn is a node with the ENS registry and a single resolver for every name, forward resolving to forward and reverse
+// resolving to reverse, with the resolver reverting while broken
+type ensStandIn struct {
+	forward atomic.Pointer[common.Address]
+	reverse atomic.Pointer[string]
+	broken  atomic.Bool
+}
+
+func selector(signature string) []byte {
+	return crypto.Keccak256([]byte(signature))[:4]
+}
+
+func newENSStandIn(t *testing.T) *ensStandIn {
+	n := &ensStandIn{}
+	stringType, _ := abi.NewType("string", "", nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		switch req.Method {
+		case "eth_blockNumber":
+			resp["result"] = "0x10"
+		case "eth_getBalance":
+			resp["result"] = hexutil.EncodeBig(ether(15))
+		case "eth_call":
+			var call struct {
+				To   common.Address `json:"to"`
+				Data hexutil.Bytes  `json:"data"`
+			}
+			json.Unmarshal(req.Params[0], &call)
+			sig := call.Data[:4]
+			switch {
+			case n.broken.Load() && call.To == ensResolver:
+				resp["error"] = map[string]interface{}{"code": -32000, "message": "execution reverted"}
+			case bytes.Equal(sig, selector("owner(bytes32)")), bytes.Equal(sig, selector("resolver(bytes32)")):
+				resp["result"] = hexutil.Bytes(common.LeftPadBytes(ensResolver.Bytes(), 32))
+			case bytes.Equal(sig, selector("addr(bytes32)")):
+				resp["result"] = hexutil.Bytes(common.LeftPadBytes(n.forward.Load().Bytes(), 32))
+			case bytes.Equal(sig, selector("name(bytes32)")):
+				name, _ := abi.Arguments{{Type: stringType}}.Pack(*n.reverse.Load())
+				resp["result"] = hexutil.Bytes(name)
+			default:
+				//anything else, such as the registrar asked for an expiry, isn't deployed
+				resp["error"] = map[string]interface{}{"code": -32000, "message": "execution reverted"}
+			}
+		default:
+			t.Errorf("unexpected call of %s", req.Method)
+			resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	oldClient, oldTokens, oldAddresses := client, loadedTokens.Load(), addressList
+	client = newRPCPool([]string{server.URL}, "priority")
+	setTokenList(nil)
+	t.Cleanup(func() {
+		client, addressList = oldClient, oldAddresses
+		loadedTokens.Store(oldTokens)
+	})
+	n.forward.Store(&ensOld)
+	name := "vault.eth"
+	n.reverse.Store(&name)
+	return n
+}
+
+func TestENSMoveScansNewAddress(t *testing.T) {
+	n := newENSStandIn(t)
+	old := Balance{symbol: "ETH"}
+	old.succeeded(big.NewInt(1), 1)
+	addressList = []Address{{name: "vault.eth", input: "vault.eth", ens: "vault.eth", address: ensOld, balances: []Balance{old}, scanned: true}}
+
+	n.forward.Store(&ensNew)
+	refreshENS(context.Background())
+	v := addressList[0]
+	if v.address != ensNew {
+		t.Fatalf("address = %s after the record moved, want %s", v.address, ensNew)
+	}
+	if !v.scanned || len(v.balances) != 1 || v.balances[0].amount.Cmp(ether(15)) != 0 {
+		t.Errorf("balances = %v, want the new address scanned at 1.5 ETH", v.balances)
+	}
+}
+
+func TestReverseENSKeptWhenLookupFails(t *testing.T) {
+	n := newENSStandIn(t)
+	addressList = []Address{{name: "vault.eth", input: ensOld.Hex(), ens: "vault.eth", address: ensOld}}
+
+	n.broken.Store(true)
+	refreshENS(context.Background())
+	if addressList[0].ens != "vault.eth" || addressList[0].name != "vault.eth" {
+		t.Errorf("name = %q (ens %q) after a failed lookup, want vault.eth kept", addressList[0].name, addressList[0].ens)
+	}
+
+	//the record still exists but points elsewhere, so the name is no longer verified
+	n.broken.Store(false)
+	n.forward.Store(&ensNew)
+	refreshENS(context.Background())
+	if addressList[0].ens != "" || addressList[0].name != ensOld.Hex() {
+		t.Errorf("name = %q (ens %q) after the name moved away, want the address", addressList[0].name, addressList[0].ens)
+	}
+}
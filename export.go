@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/xuri/excelize/v2"
+)
+
+var (
+	exportColumns = []string{"block", "timestamp", "name", "address", "symbol", "token", "balance", "currency", "price", "value", "error"}
+	exportCache   = map[uint64]cachedSnapshot{}
+	exportCacheMu sync.Mutex
+	//errBadSnapshotPoint is wrapped when the block or time asked for can't be snapshotted, rather than the node failing
+	errBadSnapshotPoint = errors.New("invalid snapshot point")
+)
+
+// cachedSnapshot is a snapshot served by /api/v1/export, reused until expires
+type cachedSnapshot struct {
+	snap    *balanceSnapshot
+	expires time.Time
+}
+
+// balanceSnapshot is every non-zero balance of the watched wallets at a block
+type balanceSnapshot struct {
+	block uint64
+	time  time.Time
+	rows  []snapshotRow
+}
+
+// snapshotRow is a balance in a snapshot, balance is the exact decimal amount and empty if the lookup failed
+type snapshotRow struct {
+	name    string
+	address string
+	symbol  string
+	token   string
+	balance string
+	price   *float64
+	value   *float64
+	err     error
+}
+
+// blockHeader is the part of a block needed to find a block by time
+type blockHeader struct {
+	Number    hexutil.Uint64 `json:"number"`
+	Timestamp hexutil.Uint64 `json:"timestamp"`
+}
+
+func getHeader(ctx context.Context, number *uint64) (*blockHeader, error) {
+	tag := "latest"
+	if number != nil {
+		tag = hexutil.EncodeUint64(*number)
+	}
+	var header *blockHeader
+	err := client.rawCall(ctx, &header, "eth_getBlockByNumber", tag, false)
+	if err == nil && header == nil && number != nil {
+		//nodes answer null for blocks they don't have yet
+		err = fmt.Errorf("%w: block %d is after the latest block", errBadSnapshotPoint, *number)
+	} else if err == nil && header == nil {
+		err = fmt.Errorf("block %s not found", tag)
+	}
+	return header, err
+}
+
+// findBlock binary searches for the last block at or before t, failing with errBadSnapshotPoint if t is before the first block
+func findBlock(ctx context.Context, t time.Time) (uint64, error) {
+	latest, err := getHeader(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if uint64(latest.Timestamp) <= uint64(t.Unix()) {
+		return uint64(latest.Number), nil
+	}
+	low, high := uint64(0), uint64(latest.Number)
+	for low < high {
+		mid := (low + high + 1) / 2
+		header, err := getHeader(ctx, &mid)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(header.Timestamp) <= uint64(t.Unix()) {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	if low == 0 {
+		genesis, err := getHeader(ctx, &low)
+		if err != nil {
+			return 0, err
+		}
+		if t.Unix() < int64(genesis.Timestamp) {
+			return 0, fmt.Errorf("%w: %s is before the first block", errBadSnapshotPoint, t.Format(time.RFC3339))
+		}
+	}
+	return low, nil
+}
+
+// parseSnapshotPoint reads a block number, RFC3339 time or "latest" (empty) into the block to snapshot
+func parseSnapshotPoint(ctx context.Context, point string) (uint64, error) {
+	if point == "" || point == "latest" {
+		header, err := getHeader(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(header.Number), nil
+	}
+	if n, err := strconv.ParseUint(point, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, point)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q is not a block number or RFC3339 time", errBadSnapshotPoint, point)
+	}
+	return findBlock(ctx, t)
+}
+
+// takeSnapshot looks up every token of every watched wallet at block, which needs an archive node for older blocks.
+// Lookups that fail are kept as rows with the error, so a snapshot is never silently incomplete
+func takeSnapshot(ctx context.Context, block uint64) (*balanceSnapshot, error) {
+	header, err := getHeader(ctx, &block)
+	if err != nil {
+		return nil, err
+	}
+	snap := &balanceSnapshot{block: block, time: time.Unix(int64(header.Timestamp), 0).UTC()}
+	at := new(big.Int).SetUint64(block)
+	fiatPrices := map[string]*float64{}
+	for _, v := range watchedAddresses() {
+		eth := snapshotRow{name: v.name, address: v.address.Hex(), symbol: "ETH"}
+		if amount, err := getEthBalanceAt(ctx, v.address, at); err != nil {
+			eth.err = err
+			snap.rows = append(snap.rows, eth)
+		} else if amount.Sign() > 0 {
+			eth.balance = formatUnits(amount, 18)
+			snap.rows = append(snap.rows, eth)
+		}
+		for _, token := range currentTokens() {
+			row := snapshotRow{name: v.name, address: v.address.Hex(), symbol: token.Symbol, token: token.realAddress.Hex()}
+			amount, err := getTokenBalanceAt(ctx, token, v.address, at)
+			//the token wasn't deployed yet
+			if errors.Is(err, bind.ErrNoCode) {
+				continue
+			}
+			if err != nil {
+				row.err = err
+				snap.rows = append(snap.rows, row)
+				continue
+			}
+			if amount.Sign() > 0 {
+				row.balance = formatUnits(amount, token.Decimals)
+				snap.rows = append(snap.rows, row)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if fiatCurrency == "" {
+		return snap, nil
+	}
+	for i, row := range snap.rows {
+		if row.err != nil {
+			continue
+		}
+		p, ok := fiatPrices[row.token]
+		if !ok {
+			if price, found := historicalPrice(ctx, common.HexToAddress(row.token), snap.time); found {
+				p = &price
+			}
+			fiatPrices[row.token] = p
+		}
+		if p == nil {
+			continue
+		}
+		amount, _ := new(big.Float).SetString(row.balance)
+		value, _ := new(big.Float).Mul(amount, big.NewFloat(*p)).Float64()
+		snap.rows[i].price, snap.rows[i].value = p, &value
+	}
+	return snap, nil
+}
+
+func (s *balanceSnapshot) records() [][]string {
+	records := make([][]string, 0, len(s.rows))
+	for _, row := range s.rows {
+		record := []string{strconv.FormatUint(s.block, 10), s.time.Format(time.RFC3339), row.name, row.address, row.symbol, row.token, row.balance, "", "", "", ""}
+		if row.price != nil {
+			record[7] = fiatCurrency
+			record[8] = strconv.FormatFloat(*row.price, 'f', -1, 64)
+			record[9] = strconv.FormatFloat(*row.value, 'f', 2, 64)
+		}
+		if row.err != nil {
+			record[10] = row.err.Error()
+		}
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i][2] < records[j][2] })
+	return records
+}
+
+func (s *balanceSnapshot) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+	cw.WriteAll(s.records())
+	return cw.Error()
+}
+
+func (s *balanceSnapshot) writeXLSX(w io.Writer) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := "Balances"
+	f.SetSheetName("Sheet1", sheet)
+	for i, record := range append([][]string{exportColumns}, s.records()...) {
+		row := make([]interface{}, len(record))
+		for j, cell := range record {
+			row[j] = cell
+			//numbers as numbers so they can be summed, the balance keeps its exact decimal as text
+			if i > 0 && (j == 0 || j == 8 || j == 9) && cell != "" {
+				if n, err := strconv.ParseFloat(cell, 64); err == nil {
+					row[j] = n
+				}
+			}
+		}
+		cellName, _ := excelize.CoordinatesToCellName(1, i+1)
+		if err := f.SetSheetRow(sheet, cellName, &row); err != nil {
+			return err
+		}
+	}
+	return f.Write(w)
+}
+
+func (s *balanceSnapshot) write(w io.Writer, format string) error {
+	switch format {
+	case "csv":
+		return s.writeCSV(w)
+	case "xlsx":
+		return s.writeXLSX(w)
+	}
+	return fmt.Errorf("unknown format %q, expected csv or xlsx", format)
+}
+
+// snapshotAt returns the snapshot of block taken in the last probeCacheTTL, otherwise takes it.
+// Snapshots with failed lookups are only reused for probeRetry
+func snapshotAt(ctx context.Context, block uint64) (*balanceSnapshot, error) {
+	exportCacheMu.Lock()
+	cached, ok := exportCache[block]
+	exportCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.snap, nil
+	}
+	snap, err := takeSnapshot(ctx, block)
+	if err != nil {
+		return nil, err
+	}
+	ttl := probeCacheTTL
+	for _, row := range snap.rows {
+		if row.err != nil {
+			ttl = min(probeRetry, probeCacheTTL)
+		}
+	}
+	now := time.Now()
+	exportCacheMu.Lock()
+	defer exportCacheMu.Unlock()
+	for b, c := range exportCache {
+		if now.After(c.expires) {
+			delete(exportCache, b)
+		}
+	}
+	exportCache[block] = cachedSnapshot{snap: snap, expires: now.Add(ttl)}
+	return snap, nil
+}
+
+// handleExport serves a snapshot of every balance at ?block=N or ?time=RFC3339 (latest by default) as ?format=csv or xlsx
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "xlsx" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be csv or xlsx"})
+		return
+	}
+	point := q.Get("block")
+	if point == "" {
+		point = q.Get("time")
+	}
+	//a snapshot is a call per wallet and token, so exports share the probe slots rather than each running its own
+	select {
+	case probeSlots <- struct{}{}:
+		defer func() { <-probeSlots }()
+	case <-r.Context().Done():
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": fmt.Sprintf("timed out waiting for one of %d probe slots", cap(probeSlots))})
+		return
+	}
+	block, err := parseSnapshotPoint(r.Context(), point)
+	if errors.Is(err, errBadSnapshotPoint) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	snap, err := snapshotAt(r.Context(), block)
+	if errors.Is(err, errBadSnapshotPoint) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"balances-%d.%s\"", block, format))
+	if format == "xlsx" {
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+	}
+	if err := snap.write(w, format); err != nil {
+		log.Errorf("Could not write export: %s", err)
+	}
+}
+
+// runSnapshot is the snapshot subcommand, writing every balance at a block or time (args[0], latest by default) to exportOutput
+func runSnapshot(ctx context.Context, args []string) error {
+	point := ""
+	if len(args) > 0 {
+		point = args[0]
+	}
+	block, err := parseSnapshotPoint(ctx, point)
+	if err != nil {
+		return err
+	}
+	log.Infof("Taking snapshot of %d addresses at block %d", len(watchedAddresses()), block)
+	snap, err := takeSnapshot(ctx, block)
+	if err != nil {
+		return err
+	}
+	out := io.Writer(os.Stdout)
+	if exportOutput != "" && exportOutput != "-" {
+		f, err := os.Create(exportOutput)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	return snap.write(out, exportFormat)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/xuri/excelize/v2"
+)
+
+// withExport watches one wallet with no tokens and a single probe slot for export tests
+func withExport(t *testing.T) {
+	oldSlots, oldTTL, oldRetry, oldTokens, oldPublished := probeSlots, probeCacheTTL, probeRetry, loadedTokens.Load(), published.Load()
+	probeSlots, probeCacheTTL, probeRetry = make(chan struct{}, 1), time.Minute, time.Second*15
+	setTokenList(nil)
+	wallet := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	published.Store(&refreshSnapshot{addresses: []Address{{name: "wallet", address: wallet}}})
+	exportCacheMu.Lock()
+	exportCache = map[uint64]cachedSnapshot{}
+	exportCacheMu.Unlock()
+	t.Cleanup(func() {
+		probeSlots, probeCacheTTL, probeRetry = oldSlots, oldTTL, oldRetry
+		loadedTokens.Store(oldTokens)
+		published.Store(oldPublished)
+		exportCacheMu.Lock()
+		exportCache = map[uint64]cachedSnapshot{}
+		exportCacheMu.Unlock()
+	})
+}
+
+func export(ctx context.Context, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handleExport(w, httptest.NewRequest(http.MethodGet, "/api/v1/export?"+query, nil).WithContext(ctx))
+	return w
+}
+
+func TestExportIsCached(t *testing.T) {
+	calls := newFixtureNode(t)
+	withExport(t)
+
+	first := export(context.Background(), "block=16")
+	if first.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", first.Code, first.Body)
+	}
+	want := "block,timestamp,name,address,symbol,token,balance,currency,price,value,error\n" +
+		"16,2024-01-01T00:00:00Z,wallet,0x5555555555555555555555555555555555555555,ETH,,1.5,,,,\n"
+	if first.Body.String() != want {
+		t.Errorf("export = %q, want %q", first.Body, want)
+	}
+	made := calls.Load()
+
+	second := export(context.Background(), "block=16")
+	if second.Body.String() != want {
+		t.Errorf("second export = %q, want %q", second.Body, want)
+	}
+	if calls.Load() != made {
+		t.Errorf("second export made %d calls, want it served from the cache", calls.Load()-made)
+	}
+}
+
+func TestExportWaitsForAProbeSlot(t *testing.T) {
+	calls := newFixtureNode(t)
+	withExport(t)
+
+	probeSlots <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if w := export(ctx, "block=16"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d with every probe slot taken, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if calls.Load() != 0 {
+		t.Errorf("made %d calls without a probe slot", calls.Load())
+	}
+
+	<-probeSlots
+	if w := export(context.Background(), "block=16"); w.Code != http.StatusOK {
+		t.Errorf("status %d once a slot is free: %s", w.Code, w.Body)
+	}
+}
+
+// chainStart is the time of the first block of withChain, each following block being 12 seconds later
+var chainStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// withChain is a node whose chain has blocks 0 to head, answering null for later blocks like nodes do
+func withChain(t *testing.T, head uint64) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		switch req.Method {
+		case "eth_getBlockByNumber":
+			number := head
+			var tag string
+			json.Unmarshal(req.Params[0], &tag)
+			if tag != "latest" {
+				n, err := hexutil.DecodeUint64(tag)
+				if err != nil {
+					t.Errorf("block %q: %s", tag, err)
+				}
+				number = n
+			}
+			resp["result"] = nil
+			if number <= head {
+				resp["result"] = blockHeader{Number: hexutil.Uint64(number), Timestamp: hexutil.Uint64(chainStart.Unix() + int64(number)*12)}
+			}
+		case "eth_getBalance":
+			resp["result"] = hexutil.EncodeBig(ether(15))
+		default:
+			t.Errorf("unexpected call of %s", req.Method)
+			resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	oldClient := client
+	client = newRPCPool([]string{server.URL}, "priority")
+	t.Cleanup(func() {
+		client = oldClient
+	})
+}
+
+func TestFindBlock(t *testing.T) {
+	withChain(t, 100)
+	for _, c := range []struct {
+		name string
+		at   time.Time
+		want uint64
+		bad  bool
+	}{
+		{name: "exact", at: chainStart.Add(time.Second * 37 * 12), want: 37},
+		{name: "between blocks", at: chainStart.Add(time.Second*37*12 + time.Second*11), want: 37},
+		{name: "first block", at: chainStart, want: 0},
+		{name: "before the first block", at: chainStart.Add(-time.Second), bad: true},
+		{name: "latest block", at: chainStart.Add(time.Second * 100 * 12), want: 100},
+		{name: "future", at: chainStart.Add(time.Hour * 24), want: 100},
+	} {
+		block, err := findBlock(context.Background(), c.at)
+		if c.bad {
+			if !errors.Is(err, errBadSnapshotPoint) {
+				t.Errorf("%s: err = %v, want a bad snapshot point", c.name, err)
+			}
+			continue
+		}
+		if err != nil || block != c.want {
+			t.Errorf("%s: block %d (%v), want %d", c.name, block, err, c.want)
+		}
+	}
+}
+
+func TestExportRejectsMissingBlocks(t *testing.T) {
+	withChain(t, 100)
+	withExport(t)
+
+	for _, query := range []string{"block=101", "time=2023-12-31T23:59:59Z", "block=latest1"} {
+		if w := export(context.Background(), query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d: %s", query, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+	if w := export(context.Background(), "time=2024-01-01T00:01:00Z"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\n5,2024-01-01T00:01:00Z,wallet,") {
+		t.Errorf("status %d, want block 5: %s", w.Code, w.Body)
+	}
+}
+
+func TestWriteXLSX(t *testing.T) {
+	oldCurrency := fiatCurrency
+	fiatCurrency = "usd"
+	t.Cleanup(func() {
+		fiatCurrency = oldCurrency
+	})
+	price, value := 2500.5, 3750.75
+	snap := &balanceSnapshot{block: 16, time: chainStart, rows: []snapshotRow{
+		{name: "wallet", address: "0x5555555555555555555555555555555555555555", symbol: "ETH", balance: "1.5", price: &price, value: &value},
+		{name: "wallet", address: "0x5555555555555555555555555555555555555555", symbol: "DAI", token: "0x2222222222222222222222222222222222222222", err: errors.New("execution timeout")},
+	}}
+	var out bytes.Buffer
+	if err := snap.writeXLSX(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := excelize.OpenReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := f.GetRows("Balances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		exportColumns,
+		{"16", "2024-01-01T00:00:00Z", "wallet", "0x5555555555555555555555555555555555555555", "ETH", "", "1.5", "usd", "2500.5", "3750.75"},
+		{"16", "2024-01-01T00:00:00Z", "wallet", "0x5555555555555555555555555555555555555555", "DAI", "0x2222222222222222222222222222222222222222", "", "", "", "", "execution timeout"},
+	}
+	if fmt.Sprint(rows) != fmt.Sprint(want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+	//the block, price and value are numbers, the balance text so it keeps every decimal
+	for cell, number := range map[string]bool{"A2": true, "I2": true, "J2": true, "G2": false, "B2": false} {
+		typ, err := f.GetCellType("Balances", cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isNumber := typ == excelize.CellTypeNumber || typ == excelize.CellTypeUnset
+		if isNumber != number {
+			t.Errorf("%s has type %d, want a number %t", cell, typ, number)
+		}
+	}
+}
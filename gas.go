@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	gasUsedTotal = newCounterVec()
+	feesTotal    = newCounterVec()
+	feeTxsTotal  = newCounterVec()
+
+	gasBucket = []byte("gas")
+	gasDays   = map[gasDayKey]*gasDay{}
+	//gasDaysDirty are the summaries changed since the block checkpoint was last saved
+	gasDaysDirty = map[gasDayKey]bool{}
+	gasDaysMu    sync.Mutex
+)
+
+// gasSpend is what a transaction sent by a watched wallet paid in fees, in wei
+type gasSpend struct {
+	wallet   Address
+	day      string
+	gasUsed  uint64
+	base     *big.Int
+	priority *big.Int
+	blob     *big.Int
+}
+
+type gasDayKey struct {
+	address common.Address
+	day     string
+}
+
+// gasDay is the fee summary of a wallet for one (UTC) day, fees are in wei
+type gasDay struct {
+	Transactions uint64   `json:"transactions"`
+	GasUsed      uint64   `json:"gasUsed"`
+	BaseFee      *big.Int `json:"baseFee"`
+	PriorityFee  *big.Int `json:"priorityFee"`
+	BlobFee      *big.Int `json:"blobFee"`
+}
+
+// gasDayJSON is the API representation of a gasDay, fees being exact decimal ETH
+type gasDayJSON struct {
+	Day          string `json:"day"`
+	Transactions uint64 `json:"transactions"`
+	GasUsed      uint64 `json:"gasUsed"`
+	BaseFee      string `json:"baseFee"`
+	PriorityFee  string `json:"priorityFee"`
+	BlobFee      string `json:"blobFee"`
+	Total        string `json:"total"`
+}
+
+// scanGasSpend works out the fees paid by every transaction sent from a watched wallet, including failed ones
+func scanGasSpend(ctx context.Context, watched map[common.Address]Address, block *rpcBlock) ([]gasSpend, error) {
+	var spent []gasSpend
+	day := time.Unix(int64(block.Timestamp), 0).UTC().Format("2006-01-02")
+	for _, tx := range block.Transactions {
+		wallet, ok := watched[tx.From]
+		if !ok {
+			continue
+		}
+		receipt, err := block.receipt(ctx, tx.Hash)
+		if err != nil {
+			return nil, err
+		}
+		gasUsed := new(big.Int).SetUint64(uint64(receipt.GasUsed))
+		g := gasSpend{wallet: wallet, day: day, gasUsed: uint64(receipt.GasUsed), base: new(big.Int), priority: new(big.Int), blob: new(big.Int)}
+		price := new(big.Int)
+		if receipt.EffectiveGasPrice != nil {
+			price = receipt.EffectiveGasPrice.ToInt()
+		}
+		//pre london blocks have no base fee, everything went to the miner
+		if block.BaseFee != nil {
+			g.base.Mul(gasUsed, block.BaseFee.ToInt())
+			g.priority.Mul(gasUsed, new(big.Int).Sub(price, block.BaseFee.ToInt()))
+		} else {
+			g.priority.Mul(gasUsed, price)
+		}
+		if receipt.BlobGasUsed != nil && receipt.BlobGasPrice != nil {
+			g.blob.Mul(new(big.Int).SetUint64(uint64(*receipt.BlobGasUsed)), receipt.BlobGasPrice.ToInt())
+		}
+		spent = append(spent, g)
+	}
+	return spent, nil
+}
+
+func (g gasSpend) count() {
+	labels := newLabels("name", g.wallet.name, "address", g.wallet.address.Hex())
+	gasUsedTotal.add(labels, float64(g.gasUsed))
+	feeTxsTotal.inc(labels)
+	for _, fee := range []struct {
+		name   string
+		amount *big.Int
+	}{{"base", g.base}, {"priority", g.priority}, {"blob", g.blob}} {
+		eth, _ := intToDec(fee.amount, 18).Float64()
+		feesTotal.add(labels.with("fee", fee.name), eth)
+	}
+
+	gasDaysMu.Lock()
+	defer gasDaysMu.Unlock()
+	key := gasDayKey{address: g.wallet.address, day: g.day}
+	d, ok := gasDays[key]
+	if !ok {
+		d = &gasDay{BaseFee: new(big.Int), PriorityFee: new(big.Int), BlobFee: new(big.Int)}
+		gasDays[key] = d
+	}
+	d.Transactions++
+	d.GasUsed += g.gasUsed
+	d.BaseFee.Add(d.BaseFee, g.base)
+	d.PriorityFee.Add(d.PriorityFee, g.priority)
+	d.BlobFee.Add(d.BlobFee, g.blob)
+	gasDaysDirty[key] = true
+}
+
+func gasDayStateKey(key gasDayKey) []byte {
+	return append(key.address.Bytes(), key.day...)
+}
+
+// putGasDays writes the summaries changed since the last checkpoint in tx, which saves the checkpoint along with them. gasDaysMu must be held
+func putGasDays(tx *bolt.Tx) error {
+	bucket, err := tx.CreateBucketIfNotExists(gasBucket)
+	if err != nil {
+		return err
+	}
+	for key := range gasDaysDirty {
+		data, err := json.Marshal(gasDays[key])
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(gasDayStateKey(key), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadGasDays restores the daily fee summaries from state
+func loadGasDays() {
+	if state == nil {
+		return
+	}
+	gasDaysMu.Lock()
+	defer gasDaysMu.Unlock()
+	state.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(gasBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if len(k) <= common.AddressLength {
+				return nil
+			}
+			var d gasDay
+			if err := json.Unmarshal(v, &d); err != nil {
+				log.Errorf("Could not decode gas summary: %s", err)
+				return nil
+			}
+			gasDays[gasDayKey{address: common.BytesToAddress(k[:common.AddressLength]), day: string(k[common.AddressLength:])}] = &d
+			return nil
+		})
+	})
+}
+
+// handleGas serves the per day fee summary of a watched wallet
+func handleGas(w http.ResponseWriter, r *http.Request) {
+	v, ok := findAddress(r.PathValue("address"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "wallet not watched"})
+		return
+	}
+	days := []gasDayJSON{}
+	gasDaysMu.Lock()
+	for key, d := range gasDays {
+		if key.address != v.address {
+			continue
+		}
+		total := new(big.Int).Add(d.BaseFee, d.PriorityFee)
+		total.Add(total, d.BlobFee)
+		days = append(days, gasDayJSON{
+			Day:          key.day,
+			Transactions: d.Transactions,
+			GasUsed:      d.GasUsed,
+			BaseFee:      formatUnits(d.BaseFee, 18),
+			PriorityFee:  formatUnits(d.PriorityFee, 18),
+			BlobFee:      formatUnits(d.BlobFee, 18),
+			Total:        formatUnits(total, 18),
+		})
+	}
+	gasDaysMu.Unlock()
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	writeJSON(w, http.StatusOK, days)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+func gwei(n int64) *hexutil.Big {
+	return (*hexutil.Big)(new(big.Int).Mul(big.NewInt(n), big.NewInt(1e9)))
+}
+
+func TestScanGasSpend(t *testing.T) {
+	outside := transferOutside
+	blobGas := hexutil.Uint64(131072)
+	block := &rpcBlock{
+		Timestamp: hexutil.Uint64(time.Date(2024, 1, 1, 23, 59, 59, 0, time.UTC).Unix()),
+		BaseFee:   gwei(10),
+		Transactions: []rpcTransaction{
+			{Hash: common.Hash{1}, From: transferWallet.address, To: &outside},
+			{Hash: common.Hash{2}, From: transferWallet2.address, To: &outside},
+			{Hash: common.Hash{3}, From: transferWallet.address, To: &outside},
+			{Hash: common.Hash{4}, From: outside, To: &transferWallet.address},
+		},
+		receipts: map[common.Hash]*rpcReceipt{
+			{1}: {Status: hexutil.Uint64(types.ReceiptStatusSuccessful), GasUsed: 21000, EffectiveGasPrice: gwei(12)},
+			{2}: {Status: hexutil.Uint64(types.ReceiptStatusSuccessful), GasUsed: 50000, EffectiveGasPrice: gwei(11), BlobGasUsed: &blobGas, BlobGasPrice: (*hexutil.Big)(big.NewInt(3))},
+			//failed transactions still pay for their gas
+			{3}: {Status: hexutil.Uint64(types.ReceiptStatusFailed), GasUsed: 30000, EffectiveGasPrice: gwei(10)},
+		},
+	}
+	watched := map[common.Address]Address{transferWallet.address: transferWallet, transferWallet2.address: transferWallet2}
+	spent, err := scanGasSpend(context.Background(), watched, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		wallet               string
+		gasUsed              uint64
+		base, priority, blob string
+	}{
+		{"hot", 21000, "0.00021", "0.000042", "0"},
+		{"cold", 50000, "0.0005", "0.00005", "0.000000000000393216"},
+		{"hot", 30000, "0.0003", "0", "0"},
+	}
+	if len(spent) != len(want) {
+		t.Fatalf("got %d spends, want %d", len(spent), len(want))
+	}
+	for i, w := range want {
+		g := spent[i]
+		if g.wallet.name != w.wallet || g.day != "2024-01-01" || g.gasUsed != w.gasUsed || formatUnits(g.base, 18) != w.base || formatUnits(g.priority, 18) != w.priority || formatUnits(g.blob, 18) != w.blob {
+			t.Errorf("spend %d = %s on %s used %d paying %s base %s priority %s blob, want %+v", i, g.wallet.name, g.day, g.gasUsed, formatUnits(g.base, 18), formatUnits(g.priority, 18), formatUnits(g.blob, 18), w)
+		}
+	}
+}
+
+func TestScanGasSpendBeforeLondon(t *testing.T) {
+	outside := transferOutside
+	block := &rpcBlock{
+		Transactions: []rpcTransaction{{Hash: common.Hash{1}, From: transferWallet.address, To: &outside}},
+		receipts:     map[common.Hash]*rpcReceipt{{1}: {Status: hexutil.Uint64(types.ReceiptStatusSuccessful), GasUsed: 21000, EffectiveGasPrice: gwei(20)}},
+	}
+	spent, err := scanGasSpend(context.Background(), map[common.Address]Address{transferWallet.address: transferWallet}, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//there was no base fee, the whole price went to the miner
+	if len(spent) != 1 || spent[0].base.Sign() != 0 || formatUnits(spent[0].priority, 18) != "0.00042" {
+		t.Errorf("spent %+v, want it all as priority fee", spent)
+	}
+}
+
+func TestGasDaysSummed(t *testing.T) {
+	path := withState(t)
+	gasDaysMu.Lock()
+	oldDays, oldDirty := gasDays, gasDaysDirty
+	gasDays, gasDaysDirty = map[gasDayKey]*gasDay{}, map[gasDayKey]bool{}
+	gasDaysMu.Unlock()
+	oldPublished := published.Load()
+	published.Store(&refreshSnapshot{addresses: []Address{transferWallet}})
+	t.Cleanup(func() {
+		gasDaysMu.Lock()
+		gasDays, gasDaysDirty = oldDays, oldDirty
+		gasDaysMu.Unlock()
+		published.Store(oldPublished)
+	})
+
+	spend := func(day string, base, priority int64) gasSpend {
+		return gasSpend{wallet: transferWallet, day: day, gasUsed: 21000, base: big.NewInt(base), priority: big.NewInt(priority), blob: new(big.Int)}
+	}
+	spend("2024-01-02", 3, 1).count()
+	spend("2024-01-01", 5, 2).count()
+	spend("2024-01-01", 7, 4).count()
+	err := state.Update(func(tx *bolt.Tx) error {
+		gasDaysMu.Lock()
+		defer gasDaysMu.Unlock()
+		return putGasDays(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the summaries survive a restart
+	reopenState(t, path)
+	gasDaysMu.Lock()
+	gasDays = map[gasDayKey]*gasDay{}
+	gasDaysMu.Unlock()
+	loadGasDays()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/wallets/hot/gas", nil)
+	r.SetPathValue("address", "hot")
+	handleGas(w, r)
+	var days []gasDayJSON
+	if err := json.NewDecoder(w.Body).Decode(&days); err != nil {
+		t.Fatal(err)
+	}
+	want := []gasDayJSON{
+		{Day: "2024-01-01", Transactions: 2, GasUsed: 42000, BaseFee: "0.000000000000000012", PriorityFee: "0.000000000000000006", BlobFee: "0", Total: "0.000000000000000018"},
+		{Day: "2024-01-02", Transactions: 1, GasUsed: 21000, BaseFee: "0.000000000000000003", PriorityFee: "0.000000000000000001", BlobFee: "0", Total: "0.000000000000000004"},
+	}
+	if len(days) != len(want) || days[0] != want[0] || days[1] != want[1] {
+		t.Errorf("days = %+v, want %+v", days, want)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	feePercentiles = []float64{10, 50, 90}
+	//gasPrices is replaced by the wallet loop and read by scrapes
+	gasPrices atomic.Pointer[networkFees]
+)
+
+// networkFees is the latest view of the network's fees in wei, nil fields couldn't be fetched
+type networkFees struct {
+	baseFee     *big.Int
+	priorityFee *big.Int
+	blobBaseFee *big.Int
+	// rewards are the average priority fees paid at each of feePercentiles over the last feeHistoryBlocks
+	rewards []*big.Int
+}
+
+// refreshGasPrices fetches the current network fees, giving context to balances (and what they can still pay for)
+func refreshGasPrices(ctx context.Context) {
+	var fees networkFees
+	var history *ethereum.FeeHistory
+	err := client.call(ctx, "eth_feeHistory", func(c *ethclient.Client) (err error) {
+		history, err = c.FeeHistory(ctx, feeHistoryBlocks, nil, feePercentiles)
+		return err
+	})
+	if err != nil {
+		log.Errorf("Could not get fee history: %s", err)
+	} else {
+		//the last base fee is for the next block, which is what a transaction sent now would pay
+		if len(history.BaseFee) > 0 {
+			fees.baseFee = history.BaseFee[len(history.BaseFee)-1]
+		}
+		fees.rewards = averageRewards(history.Reward)
+	}
+	err = client.call(ctx, "eth_maxPriorityFeePerGas", func(c *ethclient.Client) (err error) {
+		fees.priorityFee, err = c.SuggestGasTipCap(ctx)
+		return err
+	})
+	if err != nil {
+		log.Errorf("Could not get suggested priority fee: %s", err)
+	}
+	var blobBaseFee hexutil.Big
+	if err := client.rawCall(ctx, &blobBaseFee, "eth_blobBaseFee"); err != nil {
+		//older nodes and chains without blobs don't have it
+		log.Debugf("Could not get blob base fee: %s", err)
+	} else {
+		fees.blobBaseFee = blobBaseFee.ToInt()
+	}
+	gasPrices.Store(&fees)
+}
+
+// currentGasPrices is the last fetched view of the network's fees, never to be modified
+func currentGasPrices() networkFees {
+	if fees := gasPrices.Load(); fees != nil {
+		return *fees
+	}
+	return networkFees{}
+}
+
+func averageRewards(rewards [][]*big.Int) []*big.Int {
+	if len(rewards) == 0 {
+		return nil
+	}
+	sums := make([]*big.Int, len(feePercentiles))
+	for i := range sums {
+		sums[i] = new(big.Int)
+	}
+	for _, block := range rewards {
+		for i := range sums {
+			if i < len(block) {
+				sums[i].Add(sums[i], block[i])
+			}
+		}
+	}
+	for i := range sums {
+		sums[i].Div(sums[i], big.NewInt(int64(len(rewards))))
+	}
+	return sums
+}
+
+// affordableTransactions is how many transactions of typicalGas the wallet's ETH pays for at current fees
+func affordableTransactions(v Address) (*big.Int, bool) {
+	fees := currentGasPrices()
+	if fees.baseFee == nil || fees.priorityFee == nil {
+		return nil, false
+	}
+	for _, b := range v.balances {
+		if (b.token != TokenData{}) || b.amount == nil {
+			continue
+		}
+		cost := new(big.Int).Add(fees.baseFee, fees.priorityFee)
+		cost.Mul(cost, new(big.Int).SetUint64(typicalGas))
+		if cost.Sign() == 0 {
+			return nil, false
+		}
+		return new(big.Int).Div(b.amount, cost), true
+	}
+	return nil, false
+}
+
+// gasPriceMetrics adds the network fee samples, and what each wallet can still afford
+func gasPriceMetrics(m *exposition) {
+	fees := currentGasPrices()
+	if fees.baseFee != nil {
+		m.add("crypto_gas_base_fee_wei", nil, fees.baseFee)
+	}
+	if fees.priorityFee != nil {
+		m.add("crypto_gas_priority_fee_wei", nil, fees.priorityFee)
+	}
+	if fees.blobBaseFee != nil {
+		m.add("crypto_gas_blob_base_fee_wei", nil, fees.blobBaseFee)
+	}
+	for i, reward := range fees.rewards {
+		m.add("crypto_gas_fee_history_priority_fee_wei", newLabels("percentile", strconv.FormatFloat(feePercentiles[i], 'f', -1, 64)), reward)
+	}
+	for _, v := range watchedAddresses() {
+		if n, ok := affordableTransactions(v); ok {
+			m.add("crypto_wallet_affordable_transactions", newLabels("name", v.name, "address", v.address.Hex()), n)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	groups     = map[string][]string{}
+	groupNames []string
+)
+
+// parseGroups reads "name=member,member" group definitions, members being any address input (hex or ENS).
+// Members not already in rawAddresses are added to it so every group member is watched
+func parseGroups(definitions []string) error {
+	for _, d := range definitions {
+		name, list, ok := strings.Cut(d, "=")
+		if !ok || name == "" || list == "" {
+			return fmt.Errorf("invalid group (%s), expected name=address,address", d)
+		}
+		if _, ok := groups[name]; !ok {
+			groupNames = append(groupNames, name)
+		}
+		for _, member := range strings.Split(list, ",") {
+			member = strings.TrimSpace(member)
+			if member == "" {
+				continue
+			}
+			groups[name] = append(groups[name], member)
+			if !containsFold(rawAddresses, member) {
+				rawAddresses = append(rawAddresses, member)
+			}
+		}
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// memberAddresses finds the watched addresses of a group member, every address derived from it for an extended key
+func memberAddresses(member string) []Address {
+	if !isExtendedKey(member) {
+		if v, ok := findAddress(member); ok {
+			return []Address{v}
+		}
+		return nil
+	}
+	var derived []Address
+	for _, v := range watchedAddresses() {
+		if sourceInput(v) == member {
+			derived = append(derived, v)
+		}
+	}
+	return derived
+}
+
+// groupMetrics adds the summed balances of every group, along with their fiat value when prices are known and how many
+// balances the value is missing as they have no price
+func groupMetrics(m *exposition) {
+	for _, name := range groupNames {
+		group := newLabels("group", name)
+		//a wallet listed twice (say by hex and by ENS) only counts once
+		seen := map[common.Address]bool{}
+		sums := map[common.Address]*big.Int{}
+		var tokens []Balance
+		var value float64
+		valued := false
+		unpriced := 0
+		for _, member := range groups[name] {
+			for _, v := range memberAddresses(member) {
+				if seen[v.address] {
+					continue
+				}
+				seen[v.address] = true
+				for _, b := range v.balances {
+					if b.amount == nil {
+						continue
+					}
+					sum, ok := sums[b.token.realAddress]
+					if !ok {
+						sum = new(big.Int)
+						sums[b.token.realAddress] = sum
+						tokens = append(tokens, b)
+					}
+					sum.Add(sum, b.amount)
+					if fiatCurrency == "" {
+						continue
+					}
+					if p, ok := b.value(); ok {
+						value += p
+						valued = true
+					} else if b.amount.Sign() != 0 {
+						unpriced++
+					}
+				}
+			}
+		}
+		m.add("crypto_group_wallets", group, len(seen))
+		for _, b := range tokens {
+			m.add("crypto_group_balance", group.with("symbol", b.symbol), formatUnits(sums[b.token.realAddress], b.decimals()))
+		}
+		if valued {
+			m.add("crypto_group_value", group.with("currency", fiatCurrency), fmt.Sprintf("%0.2f", value))
+		}
+		//the value leaves these out, so a dashboard can tell it is incomplete
+		if fiatCurrency != "" {
+			m.add("crypto_group_unpriced_balances", group, unpriced)
+		}
+	}
+}
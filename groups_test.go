@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestGroupValueCountsUnpriced(t *testing.T) {
+	eth := Balance{symbol: "ETH"}
+	eth.succeeded(ether(15), 1)
+	usdc := Balance{token: probeUSDC, symbol: "USDC"}
+	usdc.succeeded(big.NewInt(1e6), 1)
+	dai := Balance{token: probeDAI, symbol: "DAI"}
+	dai.succeeded(ether(10), 1)
+	hot := Address{name: "hot", input: "hot.eth", address: common.HexToAddress("0x5555555555555555555555555555555555555555"), balances: []Balance{eth, usdc}}
+	cold := Address{name: "cold", input: "cold.eth", address: common.HexToAddress("0x7777777777777777777777777777777777777777"), balances: []Balance{dai}}
+
+	oldPublished, oldGroups, oldNames, oldCurrency := published.Load(), groups, groupNames, fiatCurrency
+	published.Store(&refreshSnapshot{addresses: []Address{hot, cold}})
+	groups, groupNames, fiatCurrency = map[string][]string{"hot": {"hot"}, "cold": {"cold"}}, []string{"hot", "cold"}, "usd"
+	pricesMu.Lock()
+	oldPrices := prices
+	prices = map[common.Address]float64{{}: 2000}
+	pricesMu.Unlock()
+	t.Cleanup(func() {
+		published.Store(oldPublished)
+		groups, groupNames, fiatCurrency = oldGroups, oldNames, oldCurrency
+		pricesMu.Lock()
+		prices = oldPrices
+		pricesMu.Unlock()
+	})
+
+	m := newExposition()
+	groupMetrics(m)
+	out := m.String()
+	for _, want := range []string{
+		`crypto_group_value{group="hot",currency="usd"} 3000.00`,
+		`crypto_group_unpriced_balances{group="hot"} 1`,
+		`crypto_group_unpriced_balances{group="cold"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %s:\n%s", want, out)
+		}
+	}
+	//nothing in cold has a price, so it has no value rather than a value of 0
+	if strings.Contains(out, `crypto_group_value{group="cold"`) {
+		t.Errorf("cold has a value without any prices:\n%s", out)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	historyBucket  = []byte("history")
+	balanceChanges = newCounterVec()
+)
+
+// historyEntry is a single observed balance change, Old and New are exact decimal amounts
+type historyEntry struct {
+	Symbol    string         `json:"symbol"`
+	Token     common.Address `json:"token"`
+	Old       string         `json:"old"`
+	New       string         `json:"new"`
+	Block     uint64         `json:"block"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+// observeChange records b's balance changing from old, old being nil when there is nothing to compare against
+func observeChange(v Address, b *Balance, old *big.Int) {
+	if old == nil || b.amount == nil || b.failing || old.Cmp(b.amount) == 0 {
+		return
+	}
+	balanceChanges.inc(newLabels("name", v.name, "address", v.address.Hex(), "symbol", b.symbol))
+	entry := historyEntry{
+		Symbol:    b.symbol,
+		Token:     b.token.realAddress,
+		Old:       formatUnits(old, b.decimals()),
+		New:       b.exact(),
+		Block:     b.block,
+		Timestamp: b.lastSuccess,
+	}
+	log.Infof("Balance of (%s) changed from %s to %s %s", v.name, entry.Old, entry.New, b.symbol)
+	recordHistory(v.address, entry)
+	recordBurn(v, b, old)
+}
+
+// historyKey orders entries by address then time, so an address' history is a single prefix scan
+func historyKey(address common.Address, t time.Time, symbol string) []byte {
+	key := append(address.Bytes(), binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))...)
+	return append(key, symbol...)
+}
+
+func recordHistory(address common.Address, entry historyEntry) {
+	if state == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Could not encode history entry: %s", err)
+		return
+	}
+	err = state.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(historyKey(address, entry.Timestamp, entry.Symbol), data)
+	})
+	if err != nil {
+		log.Errorf("Could not record history: %s", err)
+	}
+}
+
+// loadHistory returns the changes of address since the given time, optionally only of symbol
+func loadHistory(address common.Address, since time.Time, symbol string) ([]historyEntry, error) {
+	entries := []historyEntry{}
+	if since.IsZero() {
+		since = time.Unix(0, 0)
+	}
+	err := state.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+		prefix := address.Bytes()
+		c := bucket.Cursor()
+		for k, v := c.Seek(historyKey(address, since, "")); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var entry historyEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if symbol == "" || strings.EqualFold(symbol, entry.Symbol) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// pruneHistory deletes changes older than historyRetention
+func pruneHistory() {
+	if state == nil || historyRetention <= 0 {
+		return
+	}
+	cutoff := uint64(time.Now().Add(-historyRetention).UnixNano())
+	pruned := 0
+	err := state.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		if bucket == nil {
+			return nil
+		}
+		//deleting while iterating a cursor skips entries, so collect the keys first
+		var old [][]byte
+		bucket.ForEach(func(k, _ []byte) error {
+			if len(k) >= common.AddressLength+8 && binary.BigEndian.Uint64(k[common.AddressLength:]) < cutoff {
+				old = append(old, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range old {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(old)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Could not prune history: %s", err)
+		return
+	}
+	if pruned > 0 {
+		log.Infof("Pruned %d balance changes older than %s", pruned, historyRetention)
+	}
+}
+
+// handleHistory serves the recorded balance changes of a watched wallet, ?since=RFC3339 and ?symbol= narrow it down
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	if state == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "history requires --state"})
+		return
+	}
+	v, ok := findAddress(r.PathValue("address"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "wallet not watched"})
+		return
+	}
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "since must be an RFC3339 timestamp"})
+			return
+		}
+	}
+	entries, err := loadHistory(v.address, since, r.URL.Query().Get("symbol"))
+	if err != nil {
+		log.Errorf("Could not load history of (%s): %s", v.address, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "could not load history"})
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
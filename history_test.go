@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func historyChanges(entries []historyEntry) []string {
+	symbols := make([]string, len(entries))
+	for i, e := range entries {
+		symbols[i] = e.Symbol + "@" + e.New
+	}
+	return symbols
+}
+
+func TestHistoryOrderAndFilters(t *testing.T) {
+	withState(t)
+	wallet := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	other := common.HexToAddress("0x5555555555555555555555555555555555555556")
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	//recorded out of order, and another wallet whose address sorts right after
+	recordHistory(wallet, historyEntry{Symbol: "ETH", New: "3", Timestamp: start.Add(time.Hour * 3)})
+	recordHistory(wallet, historyEntry{Symbol: "ETH", New: "1", Timestamp: start.Add(time.Hour)})
+	recordHistory(other, historyEntry{Symbol: "ETH", New: "9", Timestamp: start.Add(time.Hour * 2)})
+	recordHistory(wallet, historyEntry{Symbol: "USDC", New: "2", Timestamp: start.Add(time.Hour * 2)})
+	//two symbols changing in the same refresh both kept
+	recordHistory(wallet, historyEntry{Symbol: "DAI", New: "3", Timestamp: start.Add(time.Hour * 3)})
+
+	for _, c := range []struct {
+		name   string
+		since  time.Time
+		symbol string
+		want   []string
+	}{
+		{name: "everything", want: []string{"ETH@1", "USDC@2", "DAI@3", "ETH@3"}},
+		{name: "since", since: start.Add(time.Hour * 2), want: []string{"USDC@2", "DAI@3", "ETH@3"}},
+		{name: "symbol", symbol: "eth", want: []string{"ETH@1", "ETH@3"}},
+		{name: "since and symbol", since: start.Add(time.Hour * 2), symbol: "ETH", want: []string{"ETH@3"}},
+	} {
+		entries, err := loadHistory(wallet, c.since, c.symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := historyChanges(entries); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	withState(t)
+	oldRetention := historyRetention
+	historyRetention = time.Hour * 24
+	t.Cleanup(func() {
+		historyRetention = oldRetention
+	})
+	wallet := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	other := common.HexToAddress("0x7777777777777777777777777777777777777777")
+	now := time.Now()
+	for i, age := range []time.Duration{time.Hour * 48, time.Hour * 25, time.Hour * 23, time.Minute} {
+		recordHistory(wallet, historyEntry{Symbol: "ETH", New: fmt.Sprint(i), Timestamp: now.Add(-age)})
+		recordHistory(other, historyEntry{Symbol: "ETH", New: fmt.Sprint(i), Timestamp: now.Add(-age)})
+	}
+
+	pruneHistory()
+	for _, address := range []common.Address{wallet, other} {
+		entries, err := loadHistory(address, time.Time{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := historyChanges(entries); fmt.Sprint(got) != "[ETH@2 ETH@3]" {
+			t.Errorf("%s kept %v, want the two changes of the last day", address, got)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxSink writes the metrics in InfluxDB line protocol to a write API, the metric name being the measurement with a single value field
+type influxSink struct {
+	url   string
+	token string
+	//precision is the unit of the timestamps, the precision parameter of the write API
+	precision time.Duration
+}
+
+func newInfluxSink(rawURL, token string) (*influxSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	//v2 takes ns/us/ms/s, v1 n/u/ms/s, both defaulting to nanoseconds
+	precisions := map[string]time.Duration{"": time.Nanosecond, "ns": time.Nanosecond, "n": time.Nanosecond, "us": time.Microsecond, "u": time.Microsecond, "ms": time.Millisecond, "s": time.Second}
+	precision, ok := precisions[u.Query().Get("precision")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported precision %q, expected ns, us, ms or s", u.Query().Get("precision"))
+	}
+	return &influxSink{url: rawURL, token: token, precision: precision}, nil
+}
+
+func (*influxSink) Name() string {
+	return "influxdb"
+}
+
+func (i *influxSink) Write(ctx context.Context, snap snapshot) error {
+	headers := map[string]string{"Content-Type": "text/plain; charset=utf-8"}
+	if i.token != "" {
+		headers["Authorization"] = "Token " + i.token
+	}
+	return pushRequest(ctx, http.MethodPost, i.url, []byte(i.lines(snap)), headers)
+}
+
+// lines formats every series as a line, values always being float fields so a whole number doesn't change the field's type
+func (i *influxSink) lines(snap snapshot) string {
+	var b strings.Builder
+	timestamp := snap.at.UnixNano() / int64(i.precision)
+	for _, s := range snap.series {
+		//influx has no NaN or infinity
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		b.WriteString(influxMeasurementEscaper.Replace(s.name()))
+		for _, l := range s.labels[1:] {
+			//influx rejects empty tag values
+			if l[1] == "" {
+				continue
+			}
+			fmt.Fprintf(&b, ",%s=%s", influxTagEscaper.Replace(l[0]), influxTagEscaper.Replace(l[1]))
+		}
+		fmt.Fprintf(&b, " value=%s %d\n", strconv.FormatFloat(s.value, 'g', -1, 64), timestamp)
+	}
+	return b.String()
+}
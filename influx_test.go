@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInfluxLines(t *testing.T) {
+	sink, err := newInfluxSink("http://influx:8086/api/v2/write?org=ops&bucket=wallets", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := snapshot{at: time.Unix(1700000000, 123456789), series: []series{
+		{labels: labelSet{{"__name__", "crypto_balance"}, {"name", "cold wallet, main=1"}, {"ens", ""}, {"symbol", "ETH"}}, value: 1.5},
+		{labels: labelSet{{"__name__", "crypto_wallets"}}, value: 3},
+		{labels: labelSet{{"__name__", "crypto_balance_runway_seconds"}}, value: math.Inf(1)},
+		{labels: labelSet{{"__name__", "crypto_price"}, {"symbol", "SHIB"}}, value: 1.2e-05},
+	}}
+	want := `crypto_balance,name=cold\ wallet\,\ main\=1,symbol=ETH value=1.5 1700000000123456789
+crypto_wallets value=3 1700000000123456789
+crypto_price,symbol=SHIB value=1.2e-05 1700000000123456789
+`
+	if got := sink.lines(snap); got != want {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestInfluxPrecision(t *testing.T) {
+	at := time.Unix(1700000000, 123456789)
+	for precision, want := range map[string]string{"ns": "1700000000123456789", "u": "1700000000123456", "ms": "1700000000123", "s": "1700000000"} {
+		sink, err := newInfluxSink("http://influx:8086/write?db=wallets&precision="+precision, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sink.lines(snapshot{at: at, series: []series{{labels: labelSet{{"__name__", "crypto_wallets"}}, value: 3}}}); got != "crypto_wallets value=3 "+want+"\n" {
+			t.Errorf("precision %s: %q, want timestamp %s", precision, got, want)
+		}
+	}
+	if _, err := newInfluxSink("http://influx:8086/write?db=wallets&precision=h", ""); err == nil {
+		t.Error("precision h was accepted")
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	var body, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, auth = string(b), r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	sink, err := newInfluxSink(server.URL+"/api/v2/write?precision=s", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(context.Background(), snapshot{at: time.Unix(1700000000, 0), series: []series{{labels: labelSet{{"__name__", "crypto_wallets"}}, value: 3}}}); err != nil {
+		t.Fatal(err)
+	}
+	if body != "crypto_wallets value=3 1700000000\n" || auth != "Token secret" {
+		t.Errorf("wrote %q with Authorization %q", body, auth)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxStartupBackoff caps the wait between startup attempts
+const maxStartupBackoff = time.Minute
+
+var (
+	//stage is what startup is doing, reported by /-/ready until the first full scan is done
+	stage    = "starting"
+	stageMu  sync.Mutex
+	ready    atomic.Bool
+	stopping atomic.Bool
+)
+
+func setStage(s string) {
+	stageMu.Lock()
+	defer stageMu.Unlock()
+	stage = s
+	log.Infof("Startup: %s", s)
+}
+
+// markReady is called after every full scan, the first one making the exporter ready
+func markReady() {
+	if !ready.Swap(true) {
+		log.Info("Startup: first full scan done, ready")
+	}
+}
+
+// handleHealthy is the liveness check, the process is alive as long as it answers (the node being down is not a reason to restart it)
+func handleHealthy(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+// handleReady is the readiness check, only passing once every wallet has been scanned and until shutdown starts
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if stopping.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !ready.Load() {
+		stageMu.Lock()
+		s := stage
+		stageMu.Unlock()
+		http.Error(w, "not ready: "+s, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// retry runs fn until it succeeds or ctx is cancelled, backing off exponentially between attempts
+func retry(ctx context.Context, what string, fn func(context.Context) error) error {
+	backoff := time.Second
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Errorf("Could not %s, retrying in %s: %s", what, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxStartupBackoff)
+	}
+}
+
+// pingNode checks that some geth endpoint answers
+func pingNode(ctx context.Context) error {
+	return client.call(ctx, "eth_blockNumber", func(c *ethclient.Client) error {
+		_, err := c.BlockNumber(ctx)
+		return err
+	})
+}
+
+// loadWatched sets up the watched addresses from state, the address sources and --addresses
+func loadWatched(ctx context.Context) {
+	if hasAddressSources() {
+		entries, err := readAddressSources(ctx)
+		if err != nil {
+			log.Errorf("Could not read address sources, retrying in %s: %s", addressesRefresh, err)
+		}
+		rawAddresses = setAddressEntries(entries)
+	}
+	loaded, missing := loadAddresses(rawAddresses)
+	warmStarted = len(loaded) > 0 && len(missing) == 0
+	addressList = append(loaded, parseAddresses(ctx, missing)...)
+	applyAddressEntries()
+	publishAddresses()
+}
+
+// start brings the exporter up, retrying what it depends on rather than exiting so a node or token list that is briefly
+// unavailable doesn't crash loop it. It returns once the refresh loops are running (or ctx is cancelled), they stop with ctx
+func start(ctx context.Context) *sync.WaitGroup {
+	loops := &sync.WaitGroup{}
+	run := func(loop func(context.Context)) {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			loop(ctx)
+		}()
+	}
+	run(client.healthLoop)
+	run(cleanProbeCache)
+	setStage("loading the token list")
+	if retry(ctx, "load the token list", importTokenList) != nil {
+		return loops
+	}
+	//top up amounts are in the decimals of their token, so are only known now
+	if topUpKey != nil {
+		if err := loadTopUps(); err != nil {
+			log.Fatalf("Invalid top up configuration: %s", err)
+		}
+	}
+	setStage("waiting for geth")
+	if retry(ctx, "reach geth", pingNode) != nil {
+		return loops
+	}
+	setStage("resolving addresses")
+	loadWatched(ctx)
+	if ctx.Err() != nil {
+		return loops
+	}
+	setStage("scanning balances")
+	setupSinks()
+	if addressesFile != "" || addressesDir != "" {
+		run(watchAddressSources)
+	}
+	run(walletLoop)
+	if transfers || gasSpending {
+		run(blockLoop)
+	}
+	if fiatCurrency != "" {
+		run(priceLoop)
+	}
+	return loops
+}
+
+// shutdown stops everything started by start once its context is cancelled, flushing what would otherwise be lost,
+// giving up on anything still running after shutdownTimeout
+func shutdown(server *http.Server, loops *sync.WaitGroup) {
+	stopping.Store(true)
+	log.Infof("Shutting down, waiting up to %s", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	//the server goes first, handlers read the state closed below
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Could not shut down http server: %s", err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		//only save once nothing is changing the addresses, a refresh stuck past the timeout was saved on its last tick
+		saveState()
+		closeState()
+	case <-ctx.Done():
+		//left open as the stuck refresh may still write to it, exiting releases it anyway
+		log.Warn("Refreshes didn't stop in time, not saving state")
+	}
+	flushSinks(ctx)
+	for _, f := range otelShutdown {
+		if err := f(ctx); err != nil {
+			log.Errorf("Could not flush OTLP export: %s", err)
+		}
+	}
+	log.Info("Shut down")
+}
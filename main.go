@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
@@ -18,77 +23,371 @@ import (
 
 var (
 	rawAddresses    []string
+	urls            []string
 	addressList     []Address = make([]Address, 0)
-	tokenList       []TokenData
 	port            int
-	url             string
 	lastRefresh     time.Duration
-	client          *ethclient.Client
+	lastRefreshAt   time.Time
+	lastBlock       uint64
+	client          *rpcPool
 	refreshDuration time.Duration = time.Second * 15
 	cacheTicks      uint
+	ensRefresh      time.Duration
+
+	rpcStrategy         string
+	rpcHealthInterval   time.Duration
+	rpcBreakerThreshold uint
+	rpcBackoff          time.Duration
+	rpcMaxBackoff       time.Duration
+
+	probeCacheTTL    time.Duration
+	probeTimeout     time.Duration
+	probeRetry       time.Duration
+	probeConcurrency int
+
+	statePath        string
+	warmStarted      bool
+	historyRetention time.Duration
+
+	transfers         bool
+	scanStartBlock    uint64
+	scanConfirmations uint64
+	scanBatch         uint64
+	traceAPI          string
+	gasSpending       bool
+
+	typicalGas       uint64
+	feeHistoryBlocks uint64
+
+	runwayWindow        time.Duration
+	runwayMinSpan       time.Duration
+	runwayExcludeTopUps bool
+
+	topUpKeyPath   string
+	topUpBelow     time.Duration
+	topUpAmounts   map[string]string
+	topUpCaps      map[string]string
+	topUpCooldown  time.Duration
+	topUpDryRun    bool
+	topUpAuditPath string
+
+	groupDefinitions []string
+	fiatCurrency     string
+	priceAPI         string
+	priceRefresh     time.Duration
+
+	xpubGapLimit uint
+
+	addressesFile    string
+	addressesDir     string
+	addressesURL     string
+	addressesRefresh time.Duration
+
+	sdTarget string
+
+	pushGateway  string
+	remoteWrite  string
+	pushJob      string
+	pushInstance string
+	pushRetries  uint
+	pushQueue    int
+
+	otlpEndpoint string
+	otlpProtocol string
+	otlpInsecure bool
+	otlpInterval time.Duration
+
+	influxURL     string
+	influxToken   string
+	statsdAddress string
+	statsdFormat  string
+
+	exportFormat string
+	exportOutput string
+
+	printJSON bool
+
+	shutdownTimeout time.Duration
 )
 
 func init() {
 	flag.IntVar(&port, "port", 9887, "Port to listen for http requests")
 	flag.DurationVar(&refreshDuration, "duration", time.Second*15, "Duration between re-scanning for balance changes")
-	flag.StringVar(&url, "geth", "http://localhost:8545", "Path to geth RPC")
+	flag.StringSliceVar(&urls, "geth", []string{"http://localhost:8545"}, "Path to geth RPC, multiple endpoints can be given for failover \"http://geth1:8545,http://geth2:8545\"")
+	flag.StringVar(&rpcStrategy, "geth-strategy", "priority", "How calls are spread over multiple geth endpoints, \"priority\" (first healthy in given order) or \"round-robin\"")
+	flag.DurationVar(&rpcHealthInterval, "geth-health-interval", time.Second*15, "Duration between health checks of each geth endpoint")
+	flag.UintVar(&rpcBreakerThreshold, "geth-breaker-threshold", 3, "Consecutive failures before a geth endpoint is taken out of rotation")
+	flag.DurationVar(&rpcBackoff, "geth-backoff", time.Second, "Initial duration a failed geth endpoint is taken out of rotation, doubling on each further failure")
+	flag.DurationVar(&rpcMaxBackoff, "geth-max-backoff", time.Minute*5, "Maximum duration a failed geth endpoint is taken out of rotation")
 	flag.StringSliceVar(&rawAddresses, "addresses", []string{"vitalik.eth", "0xEA674fdDe714fd979de3EdF0F56AA9716B898ec8"}, "\"address1.eth,0xDEADBEEF\"")
 	flag.UintVar(&cacheTicks, "cache", 4, "Sets amount of balance refreshes (of previously known balances) before re-scanning all potential tokens, set to 0 to always scan every token (slower)")
-	flag.Parse()
-	if len(rawAddresses) == 0 {
-		log.Panic("no addresses supplied")
+	flag.DurationVar(&ensRefresh, "ens-refresh", time.Hour, "Duration between re-resolving ENS names of addresses, set to 0 to only resolve on startup")
+	flag.DurationVar(&probeCacheTTL, "probe-cache", time.Minute, "Duration /probe results are cached for, protecting the node from frequent scrapes")
+	flag.DurationVar(&probeTimeout, "probe-timeout", time.Second*10, "Timeout of /probe lookups, which keep running and are cached when a scrape gives up sooner")
+	flag.DurationVar(&probeRetry, "probe-retry", time.Second*15, "Duration failed or incomplete /probe results are cached for before being retried")
+	flag.IntVar(&probeConcurrency, "probe-concurrency", 4, "Maximum number of /probe lookups running at once")
+	flag.StringVar(&statePath, "state", "", "Path to a file persisting discovered tokens, ENS resolutions and balances across restarts, empty to disable")
+	flag.DurationVar(&historyRetention, "history-retention", time.Hour*24*30, "Duration balance changes are kept in state for, set to 0 to keep them forever")
+	flag.BoolVar(&transfers, "transfers", false, "Scan new blocks for ETH and token transfers of the addresses, exporting transfer counts and volumes")
+	flag.Uint64Var(&scanStartBlock, "scan-start-block", 0, "Block to start scanning from when there is no checkpoint in state, 0 to start from the current head")
+	flag.Uint64Var(&scanConfirmations, "scan-confirmations", 2, "Blocks to stay behind the head when scanning, so reorged blocks aren't counted")
+	flag.Uint64Var(&scanBatch, "scan-batch", 100, "Maximum blocks scanned at once")
+	flag.StringVar(&traceAPI, "trace-api", "", "Trace API used to find ETH moved by contracts (internal transactions) when scanning transfers, \"debug\" (geth debug_traceBlockByNumber) or \"parity\" (erigon/nethermind trace_block), empty to disable")
+	flag.BoolVar(&gasSpending, "gas-spend", false, "Scan new blocks for transactions sent by the addresses, exporting gas used and fees paid")
+	flag.Uint64Var(&typicalGas, "typical-gas", 21000, "Gas used by a typical transaction of the addresses, for crypto_wallet_affordable_transactions")
+	flag.Uint64Var(&feeHistoryBlocks, "fee-history-blocks", 20, "Blocks of fee history averaged for crypto_gas_fee_history_priority_fee_wei")
+	flag.DurationVar(&runwayWindow, "runway-window", time.Hour*24, "Duration of balance changes the burn rate behind crypto_balance_runway_seconds is averaged over")
+	flag.DurationVar(&runwayMinSpan, "runway-min-span", time.Hour, "Duration balance changes must be watched for before a burn rate, runway or top up is worked out from them")
+	flag.BoolVar(&runwayExcludeTopUps, "runway-exclude-top-ups", true, "Ignore balance increases (top ups) when working out the burn rate, otherwise they offset what was spent")
+	flag.StringVar(&topUpKeyPath, "top-up-key", "", "Path to the hex private key of a funding wallet, enabling automatic top ups of wallets running low, empty to disable")
+	flag.DurationVar(&topUpBelow, "top-up-below", time.Hour*6, "Runway under which a wallet is topped up")
+	flag.StringToStringVar(&topUpAmounts, "top-up-amount", map[string]string{}, "Amount sent per top up by symbol \"ETH=0.5,USDC=1000\", symbols without an amount aren't topped up")
+	flag.StringToStringVar(&topUpCaps, "top-up-daily-cap", map[string]string{}, "Maximum sent per symbol per (UTC) day over all wallets \"ETH=2,USDC=5000\", required for every symbol with an amount")
+	flag.DurationVar(&topUpCooldown, "top-up-cooldown", time.Hour, "Minimum duration between top ups of the same wallet and symbol, so a new top up isn't sent before the last one lands")
+	flag.BoolVar(&topUpDryRun, "top-up-dry-run", false, "Only write top ups to the audit log, without sending them")
+	flag.StringVar(&topUpAuditPath, "top-up-audit", "top-ups.log", "Path of the top up audit log, every top up decision is appended as a JSON line")
+	flag.StringArrayVar(&groupDefinitions, "group", nil, "Named group of addresses exported as summed crypto_group_balance \"treasury=vault.eth,0xDEADBEEF\", can be given multiple times, members are watched even if not in --addresses")
+	flag.StringVar(&fiatCurrency, "fiat-currency", "", "Currency to price balances in (\"usd\", \"eur\"...), enabling crypto_price and crypto_group_value, empty to disable")
+	flag.StringVar(&priceAPI, "price-api", "https://api.coingecko.com/api/v3", "CoinGecko compatible API prices are fetched from")
+	flag.DurationVar(&priceRefresh, "price-refresh", time.Minute*5, "Duration between fetching prices")
+	flag.UintVar(&xpubGapLimit, "xpub-gap-limit", 20, "Addresses derived from an extended public key past the last used one, the range grows while any of the last this many are used, 0 to only derive the given range")
+	flag.StringVar(&addressesFile, "addresses-file", "", "File of addresses to watch along with --addresses, one per line or CSV of \"address,name,key=value;key=value\"")
+	flag.StringVar(&addressesDir, "addresses-dir", "", "Directory (such as a mounted Kubernetes ConfigMap) whose files list addresses in the --addresses-file format")
+	flag.StringVar(&addressesURL, "addresses-url", "", "URL polled for addresses in the --addresses-file format")
+	flag.DurationVar(&addressesRefresh, "addresses-refresh", time.Minute, "Duration between re-reading --addresses-file, --addresses-dir and --addresses-url, added and removed addresses are picked up live. The file and directory are also watched for changes")
+	flag.StringVar(&sdTarget, "sd-target", "", "host:port of this exporter in /sd targets, empty to use the host /sd was requested on")
+	flag.StringVar(&pushGateway, "push-gateway", "", "Pushgateway URL the metrics are pushed to after every refresh, for environments that can't be scraped, empty to disable")
+	flag.StringVar(&remoteWrite, "remote-write", "", "Prometheus remote write URL the metrics are sent to after every refresh, empty to disable")
+	flag.StringVar(&pushJob, "push-job", "ethwallet_exporter", "Job label of pushed metrics")
+	flag.StringVar(&pushInstance, "push-instance", "", "Instance label of pushed metrics, empty to use the hostname")
+	flag.UintVar(&pushRetries, "push-retries", 5, "Retries of a failed push or sink write, backing off exponentially from a second")
+	flag.IntVar(&pushQueue, "push-queue", 10, "Refreshes of metrics queued while a push target or sink is down, the oldest are dropped beyond that")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "host:port of an OpenTelemetry collector metrics and traces are exported to over OTLP, empty to disable")
+	flag.StringVar(&otlpProtocol, "otlp-protocol", "grpc", "OTLP protocol, \"grpc\" or \"http\"")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "Export OTLP without TLS")
+	flag.DurationVar(&otlpInterval, "otlp-interval", time.Second*30, "Duration between OTLP metric exports")
+	flag.StringVar(&influxURL, "influx-url", "", "InfluxDB write API URL the metrics are written to in line protocol after every refresh, such as \"http://influx:8086/api/v2/write?org=ops&bucket=wallets\", empty to disable")
+	flag.StringVar(&influxToken, "influx-token", "", "InfluxDB API token")
+	flag.StringVar(&statsdAddress, "statsd", "", "host:port the metrics are sent to as statsd gauges over UDP after every refresh, empty to disable")
+	flag.StringVar(&statsdFormat, "statsd-format", "dogstatsd", "How labels are sent to statsd, as \"dogstatsd\" tags or telegraf style \"statsd\" tags")
+	flag.StringVar(&exportFormat, "format", "csv", "Output format of the snapshot subcommand, \"csv\" or \"xlsx\"")
+	flag.StringVar(&exportOutput, "output", "-", "File the snapshot subcommand writes to, \"-\" for stdout")
+	flag.BoolVar(&printJSON, "json", false, "Print the results of the balance, tokens, resolve, reverse and check commands as JSON instead of a table")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", time.Second*20, "Maximum duration of a graceful shutdown on SIGTERM, stopping refreshes, flushing sinks and saving state")
+	flag.Usage = printUsage
+}
+
+// configure checks the flags and sets up what they configure, anything invalid is returned rather than half started
+func configure() error {
+	if len(rawAddresses) == 0 && !hasAddressSources() {
+		return fmt.Errorf("no addresses supplied")
+	}
+	if len(urls) == 0 {
+		return fmt.Errorf("no geth endpoints supplied")
+	}
+	if rpcStrategy != "priority" && rpcStrategy != "round-robin" {
+		return fmt.Errorf("unknown geth strategy (%s)", rpcStrategy)
+	}
+	if rpcBreakerThreshold == 0 {
+		rpcBreakerThreshold = 1
+	}
+	if traceAPI != "" && traceAPI != "debug" && traceAPI != "parity" {
+		return fmt.Errorf("unknown trace api (%s)", traceAPI)
+	}
+	if runwayWindow <= 0 {
+		return fmt.Errorf("runway window must be positive (%s)", runwayWindow)
+	}
+	if runwayMinSpan > runwayWindow {
+		return fmt.Errorf("runway min span (%s) can't be longer than the runway window (%s)", runwayMinSpan, runwayWindow)
+	}
+	if otlpProtocol != "grpc" && otlpProtocol != "http" {
+		return fmt.Errorf("unknown otlp protocol (%s)", otlpProtocol)
+	}
+	if statsdFormat != "dogstatsd" && statsdFormat != "statsd" {
+		return fmt.Errorf("unknown statsd format (%s)", statsdFormat)
+	}
+	if scanBatch == 0 {
+		scanBatch = 1
+	}
+	if probeConcurrency < 1 {
+		probeConcurrency = 1
+	}
+	probeSlots = make(chan struct{}, probeConcurrency)
+	if pushInstance == "" {
+		pushInstance, _ = os.Hostname()
 	}
-	importTokenList()
+	if pushQueue < 1 {
+		pushQueue = 1
+	}
+	fiatCurrency = strings.ToLower(fiatCurrency)
+	if err := parseGroups(groupDefinitions); err != nil {
+		return err
+	}
+	staticAddresses = rawAddresses
 	connectClient()
-	addressList = parseAddresses(rawAddresses)
+	//one-shot commands only need the token list and the node, not the watched addresses
+	if c, ok := commands[flag.Arg(0)]; ok && !c.watched {
+		return nil
+	}
+	if topUpKeyPath != "" {
+		if err := setupTopUps(); err != nil {
+			return err
+		}
+	}
+	if otlpEndpoint != "" {
+		if err := setupOTel(context.Background()); err != nil {
+			log.Errorf("Could not set up OTLP export, continuing without it: %s", err)
+		}
+	}
+	if statePath != "" {
+		openState(statePath)
+		loadGasDays()
+	}
+	return nil
 }
 
 func main() {
-	go walletLoop()
+	flag.Parse()
+	checkCommand()
+	if err := configure(); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if flag.NArg() > 0 {
+		runCommand(ctx)
+		return
+	}
 	http.HandleFunc("/metrics", handleMetrics)
-	panic(http.ListenAndServe("0.0.0.0:"+strconv.Itoa(port), nil))
+	http.HandleFunc("/probe", handleProbe)
+	http.HandleFunc("/sd", handleSD)
+	http.HandleFunc("/-/healthy", handleHealthy)
+	http.HandleFunc("/-/ready", handleReady)
+	registerAPI(http.DefaultServeMux)
+	registerDashboard(http.DefaultServeMux)
+	//requests and the probes they start are cancelled on SIGTERM rather than holding up the shutdown
+	probeCtx = ctx
+	server := &http.Server{Addr: "0.0.0.0:" + strconv.Itoa(port), BaseContext: func(net.Listener) context.Context { return ctx }}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Could not listen on port %d: %s", port, err)
+		}
+	}()
+	loops := start(ctx)
+	<-ctx.Done()
+	//a second signal kills the process straight away
+	stop()
+	shutdown(server, loops)
 }
 
 func connectClient() {
-	var err error
-	client, err = ethclient.Dial(url)
-	if err != nil {
-		panic(err)
-	}
+	client = newRPCPool(urls, rpcStrategy)
 }
 
 // importTokenList pulls down known possible tokens (uses uniswaps, there could be more but this is pretty much all)
-func importTokenList() {
+func importTokenList(ctx context.Context) error {
 	tokenlisturl := "https://raw.githubusercontent.com/Uniswap/default-token-list/main/src/tokens/mainnet.json"
-	resp, err := http.Get(tokenlisturl)
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenlisturl, nil)
 	if err != nil {
-		log.Errorf("Could not get token list: %s", err)
+		return err
 	}
-	tokenListData, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Error("Err: error reading body of response", err)
+		return err
 	}
-	json.Unmarshal(tokenListData, &tokenList)
-	if err != nil {
-		log.Error("Err: Decoding tokenlist", err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", tokenlisturl, resp.Status)
+	}
+	var list []TokenData
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("decoding token list: %w", err)
 	}
-	for i := range tokenList {
-		tokenList[i].realAddress = common.HexToAddress(tokenList[i].Address)
+	for i := range list {
+		list[i].realAddress = common.HexToAddress(list[i].Address)
 	}
+	setTokenList(list)
+	return nil
+}
+
+// tokenListLoad is a loaded token list and when it was loaded, replaced as a whole so readers never see half of an update
+type tokenListLoad struct {
+	tokens []TokenData
+	at     time.Time
+}
+
+// loadedTokens is replaced by importTokenList, which runs while the server is already answering
+var loadedTokens atomic.Pointer[tokenListLoad]
+
+func setTokenList(list []TokenData) {
+	loadedTokens.Store(&tokenListLoad{tokens: list, at: time.Now()})
+}
+
+// currentTokens is the loaded token list, empty until it is loaded and never to be modified
+func currentTokens() []TokenData {
+	if l := loadedTokens.Load(); l != nil {
+		return l.tokens
+	}
+	return nil
 }
 
 // handleMetrics is for the prometheus exporter, handling their requests
 func handleMetrics(w http.ResponseWriter, r *http.Request) {
-	var resp []string
-	for _, v := range addressList {
+	fmt.Fprintln(w, collectMetrics())
+}
+
+// collectMetrics gathers every metric, for scrapes and pushes alike
+func collectMetrics() *exposition {
+	m := newExposition()
+	refresh := lastPublished()
+	for _, v := range refresh.addresses {
 		for _, b := range v.balances {
+			labels := newLabels("name", v.name, "address", v.address.Hex(), "symbol", b.symbol)
+			success := 1
+			if b.failing {
+				success = 0
+			}
+			m.add("crypto_balance_fetch_success", labels, success)
+			m.add("crypto_balance_fetch_errors_total", labels, b.errors)
+			stale := 0
+			if b.stale {
+				stale = 1
+			}
+			m.add("crypto_balance_stale", labels, stale)
+			//never looked up successfully, there is no value to report
 			if b.balance == "" {
-				b.balance = "0"
+				continue
+			}
+			m.add("crypto_balance", labels, b.balance)
+			m.add("crypto_balance_last_success_timestamp_seconds", labels, b.lastSuccess.Unix())
+		}
+		if len(v.labels) > 0 {
+			m.add("crypto_wallet_labels", newLabels(append([]string{"name", v.name, "address", v.address.Hex()}, sourceLabelPairs(v.labels)...)...), 1)
+		}
+		m.add("crypto_token_scan_errors_total", newLabels("name", v.name, "address", v.address.Hex()), v.scanErrors)
+		if v.ens != "" {
+			m.add("crypto_ens_info", newLabels("name", v.ens, "address", v.address.Hex()), 1)
+			if !v.ensExpiry.IsZero() {
+				m.add("crypto_ens_expiry_timestamp_seconds", newLabels("name", v.ens), v.ensExpiry.Unix())
 			}
-			resp = append(resp, fmt.Sprintf("crypto_balance{name=\"%s\",address=\"%s\",symbol=\"%s\"} %v", v.name, v.address, b.symbol, b.balance))
 		}
 	}
-	resp = append(resp, fmt.Sprintf("crypto_load_seconds %0.2f", lastRefresh.Seconds()))
-	fmt.Fprintln(w, strings.Join(resp, "\n"))
+	balanceChanges.write(m, "crypto_balance_changes_total")
+	transfersTotal.write(m, "crypto_transfers_total")
+	transferVolume.write(m, "crypto_transfer_volume_total")
+	gasUsedTotal.write(m, "crypto_gas_used_total")
+	feesTotal.write(m, "crypto_fees_eth_total")
+	feeTxsTotal.write(m, "crypto_fee_transactions_total")
+	gasPriceMetrics(m)
+	runwayMetrics(m)
+	groupMetrics(m)
+	priceMetrics(m)
+	topUpsTotal.write(m, "crypto_top_ups_total")
+	client.metrics(m)
+	sinkSelfMetrics(m)
+	selfMetrics(m)
+	m.add("crypto_load_seconds", nil, fmt.Sprintf("%0.2f", refresh.took.Seconds()))
+	return m
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/metric"
+)
+
+// exposition collects samples grouped by metric name, as the prometheus text format expects every sample of a metric together.
+// Scrapes render it as text, the sinks and OTLP read its samples
+type exposition struct {
+	names   []string
+	samples map[string][]series
+}
+
+// series is a sample of a metric, the first label being __name__
+type series struct {
+	labels labelSet
+	value  float64
+	// text is the value as written in the text format, decimal balances being more precise than value
+	text string
+}
+
+// name is the metric name of s
+func (s series) name() string {
+	return s.labels[0][1]
+}
+
+func newExposition() *exposition {
+	return &exposition{samples: map[string][]series{}}
+}
+
+// add appends a sample, value being a number or a decimal string
+func (e *exposition) add(name string, labels labelSet, value interface{}) {
+	if _, ok := e.samples[name]; !ok {
+		e.names = append(e.names, name)
+	}
+	s := series{labels: append(labelSet{{"__name__", name}}, labels...), text: fmt.Sprint(value)}
+	//every value is written as a plain decimal, so is read back the same way whatever its type
+	var err error
+	if s.value, err = strconv.ParseFloat(s.text, 64); err != nil {
+		s.value = math.NaN()
+	}
+	e.samples[name] = append(e.samples[name], s)
+}
+
+// series lists every sample, grouped by metric name
+func (e *exposition) series() []series {
+	var all []series
+	for _, name := range e.names {
+		all = append(all, e.samples[name]...)
+	}
+	return all
+}
+
+func (e *exposition) String() string {
+	var b strings.Builder
+	for i, s := range e.series() {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(s.name())
+		if len(s.labels) > 1 {
+			b.WriteString("{" + s.labels[1:].String() + "}")
+		}
+		b.WriteString(" " + s.text)
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelSet is label name and value pairs, in the order they are written
+type labelSet [][2]string
+
+// newLabels pairs up label names and values, newLabels("name", name, "symbol", symbol)
+func newLabels(pairs ...string) labelSet {
+	return labelSet(nil).with(pairs...)
+}
+
+// with is a copy of l with more label name and value pairs after it
+func (l labelSet) with(pairs ...string) labelSet {
+	labels := make(labelSet, len(l), len(l)+len(pairs)/2)
+	copy(labels, l)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, [2]string{pairs[i], pairs[i+1]})
+	}
+	return labels
+}
+
+// String formats l for the text format, escaping the values as it requires.
+// Names, ENS names, symbols and source labels all come from outside, so can hold anything
+func (l labelSet) String() string {
+	var b strings.Builder
+	for i, pair := range l {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", pair[0], labelEscaper.Replace(pair[1]))
+	}
+	return b.String()
+}
+
+var (
+	//version is set with -ldflags "-X main.version=...", the Dockerfile's VERSION build arg
+	version = ""
+
+	rpcDuration  = newHistogram(0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+	rpcErrors    = newCounterVec()
+	scanDuration = newHistogram(0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600)
+)
+
+// histogram is a minimal prometheus histogram keyed by label sets, safe for concurrent use
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	order   []string
+	labels  map[string]labelSet
+	counts  map[string][]uint64
+	sums    map[string]float64
+	totals  map[string]uint64
+	// otel mirrors observations to OTLP when it is enabled
+	otel metric.Float64Histogram
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, labels: map[string]labelSet{}, counts: map[string][]uint64{}, sums: map[string]float64{}, totals: map[string]uint64{}}
+}
+
+func (h *histogram) observe(labels labelSet, v float64) {
+	if h.otel != nil {
+		h.otel.Record(context.Background(), v, metric.WithAttributes(toAttributes(labels)...))
+	}
+	key := labels.String()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.counts[key]; !ok {
+		h.order = append(h.order, key)
+		h.labels[key] = labels
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[key][i]++
+		}
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+func (h *histogram) write(m *exposition, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range h.order {
+		labels := h.labels[key]
+		for i, le := range h.buckets {
+			m.add(name+"_bucket", labels.with("le", strconv.FormatFloat(le, 'g', -1, 64)), h.counts[key][i])
+		}
+		m.add(name+"_bucket", labels.with("le", "+Inf"), h.totals[key])
+		m.add(name+"_sum", labels, h.sums[key])
+		m.add(name+"_count", labels, h.totals[key])
+	}
+}
+
+// counterVec is a set of counters keyed by label sets, safe for concurrent use
+type counterVec struct {
+	mu     sync.Mutex
+	order  []string
+	labels map[string]labelSet
+	counts map[string]float64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{labels: map[string]labelSet{}, counts: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labels labelSet) {
+	c.add(labels, 1)
+}
+
+func (c *counterVec) add(labels labelSet, v float64) {
+	key := labels.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.counts[key]; !ok {
+		c.order = append(c.order, key)
+		c.labels[key] = labels
+	}
+	c.counts[key] += v
+}
+
+func (c *counterVec) write(m *exposition, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.order {
+		m.add(name, c.labels[key], c.counts[key])
+	}
+}
+
+// buildVersion is the version set at link time, otherwise the module version go recorded (a tag, or a pseudo-version
+// when built from a checkout), dev if neither is known, along with the VCS revision
+func buildVersion() (string, string) {
+	v, revision := version, "unknown"
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return cmp.Or(v, "dev"), revision
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			revision = s.Value
+		}
+	}
+	if v == "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	return cmp.Or(v, "dev"), revision
+}
+
+// selfMetrics adds metrics about the exporter itself
+func selfMetrics(m *exposition) {
+	v, revision := buildVersion()
+	m.add("crypto_exporter_build_info", newLabels("version", v, "revision", revision, "goversion", runtime.Version()), 1)
+	rpcDuration.write(m, "crypto_rpc_duration_seconds")
+	rpcErrors.write(m, "crypto_rpc_errors_total")
+	scanDuration.write(m, "crypto_scan_duration_seconds")
+	list := watchedAddresses()
+	balances := 0
+	for _, v := range list {
+		balances += len(v.balances)
+	}
+	m.add("crypto_wallets", nil, len(list))
+	m.add("crypto_balances", nil, balances)
+	if l := loadedTokens.Load(); l != nil {
+		m.add("crypto_token_list_size", nil, len(l.tokens))
+		m.add("crypto_token_list_last_update_timestamp_seconds", nil, l.at.Unix())
+	} else {
+		m.add("crypto_token_list_size", nil, 0)
+	}
+}
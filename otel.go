@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	//tracer is a no-op until setupOTel sets the global provider
+	tracer = otel.Tracer("github.com/RyanCarrier/ethwallet_exporter")
+	//otelShutdown flushes and stops the OTLP exporters
+	otelShutdown []func(context.Context) error
+
+	//otelHistograms are recorded as they are observed, rather than observed from collectMetrics like every other metric
+	otelHistograms = map[string]*histogram{"crypto_rpc_duration_seconds": rpcDuration, "crypto_scan_duration_seconds": scanDuration}
+)
+
+// setupOTel starts exporting metrics and traces over OTLP to otlpEndpoint
+func setupOTel(ctx context.Context) error {
+	version, _ := buildVersion()
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", "ethwallet_exporter"), attribute.String("service.version", version)),
+	)
+	if err != nil {
+		return err
+	}
+	var traceExporter sdktrace.SpanExporter
+	var metricExporter sdkmetric.Exporter
+	switch otlpProtocol {
+	case "grpc":
+		traceOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(otlpEndpoint)}
+		metricOpts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(otlpEndpoint)}
+		if otlpInsecure {
+			traceOpts = append(traceOpts, otlptracegrpc.WithInsecure())
+			metricOpts = append(metricOpts, otlpmetricgrpc.WithInsecure())
+		}
+		if traceExporter, err = otlptracegrpc.New(ctx, traceOpts...); err != nil {
+			return err
+		}
+		if metricExporter, err = otlpmetricgrpc.New(ctx, metricOpts...); err != nil {
+			return err
+		}
+	case "http":
+		traceOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(otlpEndpoint)}
+		metricOpts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(otlpEndpoint)}
+		if otlpInsecure {
+			traceOpts = append(traceOpts, otlptracehttp.WithInsecure())
+			metricOpts = append(metricOpts, otlpmetrichttp.WithInsecure())
+		}
+		if traceExporter, err = otlptracehttp.New(ctx, traceOpts...); err != nil {
+			return err
+		}
+		if metricExporter, err = otlpmetrichttp.New(ctx, metricOpts...); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown otlp protocol %q", otlpProtocol)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter), sdktrace.WithResource(res))
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter, sdkmetric.WithInterval(otlpInterval))), sdkmetric.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetMeterProvider(mp)
+	otelShutdown = append(otelShutdown, tp.Shutdown, mp.Shutdown)
+
+	meter := mp.Meter("github.com/RyanCarrier/ethwallet_exporter")
+	observer := &otelObserver{meter: meter}
+	observer.instruments.Store(&map[string]metric.Float64Observable{})
+	if err := observer.instrument(otelNames(collectMetrics().series())); err != nil {
+		return err
+	}
+	for name, h := range otelHistograms {
+		if h.otel, err = meter.Float64Histogram(name, metric.WithUnit("s"), metric.WithExplicitBucketBoundaries(h.buckets...)); err != nil {
+			return err
+		}
+	}
+	log.Infof("Exporting metrics and traces over OTLP (%s) to %s", otlpProtocol, otlpEndpoint)
+	return nil
+}
+
+// otelObserver exports collectMetrics over OTLP, with an instrument for every metric collected so far
+type otelObserver struct {
+	meter metric.Meter
+	//mu serialises instrument, the callback reads instruments without it
+	mu           sync.Mutex
+	instruments  atomic.Pointer[map[string]metric.Float64Observable]
+	registration metric.Registration
+	//adding is set while instruments for newly collected metrics are being added
+	adding atomic.Bool
+}
+
+// otelNames lists the metrics of samples observed over OTLP, leaving out the parts of histograms
+func otelNames(samples []series) []string {
+	var names []string
+	for _, s := range samples {
+		name := s.name()
+		if len(names) > 0 && names[len(names)-1] == name {
+			continue
+		}
+		if !recordedAsHistogram(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// recordedAsHistogram is whether name is a bucket, sum or count of one of otelHistograms
+func recordedAsHistogram(name string) bool {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if _, ok := otelHistograms[strings.TrimSuffix(name, suffix)]; ok && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// instrument adds a counter for each new metric in names ending in _total and a gauge for the rest, then observes them all in one callback.
+// The SDK holds the lock instruments are added under while it runs callbacks, so this can't be called from one
+func (o *otelObserver) instrument(names []string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	old := *o.instruments.Load()
+	instruments := make(map[string]metric.Float64Observable, len(old))
+	for name, inst := range old {
+		instruments[name] = inst
+	}
+	for _, name := range names {
+		if _, ok := instruments[name]; ok {
+			continue
+		}
+		var inst metric.Float64Observable
+		var err error
+		if strings.HasSuffix(name, "_total") {
+			inst, err = o.meter.Float64ObservableCounter(name)
+		} else {
+			inst, err = o.meter.Float64ObservableGauge(name)
+		}
+		if err != nil {
+			return err
+		}
+		instruments[name] = inst
+	}
+	if len(instruments) == len(old) {
+		return nil
+	}
+	observables := make([]metric.Observable, 0, len(instruments))
+	for _, inst := range instruments {
+		observables = append(observables, inst)
+	}
+	if o.registration != nil {
+		if err := o.registration.Unregister(); err != nil {
+			return err
+		}
+	}
+	o.instruments.Store(&instruments)
+	registration, err := o.meter.RegisterCallback(o.observe, observables...)
+	if err != nil {
+		return err
+	}
+	o.registration = registration
+	return nil
+}
+
+// observe is the callback observing every collected metric that has an instrument
+func (o *otelObserver) observe(_ context.Context, observer metric.Observer) error {
+	instruments := *o.instruments.Load()
+	samples := collectMetrics().series()
+	missing := false
+	for _, s := range samples {
+		if inst, ok := instruments[s.name()]; ok {
+			observer.ObserveFloat64(inst, s.value, metric.WithAttributes(toAttributes(s.labels[1:])...))
+		} else if !recordedAsHistogram(s.name()) {
+			missing = true
+		}
+	}
+	//metrics that weren't collected before (such as a first transfer) are exported from the next collection on
+	if missing && o.adding.CompareAndSwap(false, true) {
+		go func() {
+			defer o.adding.Store(false)
+			if err := o.instrument(otelNames(samples)); err != nil {
+				log.Errorf("Could not add OTLP instruments: %s", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func toAttributes(labels [][2]string) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(labels))
+	for _, l := range labels {
+		attrs = append(attrs, attribute.String(l[0], l[1]))
+	}
+	return attrs
+}
+
+// endSpan ends span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// newOTLPCollector accepts OTLP over HTTP, decoding each metrics export onto exports
+func newOTLPCollector(t *testing.T, exports chan<- map[string]*metricspb.Metric) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if r.URL.Path != "/v1/metrics" {
+			//traces
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("metrics exported as %s", r.Header.Get("Content-Type"))
+		}
+		var req collectormetrics.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			t.Errorf("body isn't an ExportMetricsServiceRequest: %s", err)
+			return
+		}
+		metrics := map[string]*metricspb.Metric{}
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					metrics[m.Name] = m
+				}
+			}
+		}
+		select {
+		case exports <- metrics:
+		default:
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// awaitExport waits for an export holding every metric in names
+func awaitExport(t *testing.T, exports <-chan map[string]*metricspb.Metric, names ...string) map[string]*metricspb.Metric {
+	t.Helper()
+	timeout := time.After(time.Second * 10)
+	for {
+		select {
+		case metrics := <-exports:
+			complete := true
+			for _, name := range names {
+				if metrics[name] == nil {
+					complete = false
+				}
+			}
+			if complete {
+				return metrics
+			}
+		case <-timeout:
+			t.Fatalf("no export with %v", names)
+		}
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	exports := make(chan map[string]*metricspb.Metric, 1)
+	server := newOTLPCollector(t, exports)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldEndpoint, oldProtocol, oldInsecure, oldInterval, oldTopUps := otlpEndpoint, otlpProtocol, otlpInsecure, otlpInterval, topUpsTotal
+	otlpEndpoint, otlpProtocol, otlpInsecure, otlpInterval = u.Host, "http", true, time.Millisecond*100
+	topUpsTotal = newCounterVec()
+	t.Cleanup(func() {
+		for _, f := range otelShutdown {
+			f(context.Background())
+		}
+		otelShutdown = nil
+		for _, h := range otelHistograms {
+			h.otel = nil
+		}
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		otel.SetMeterProvider(metricnoop.NewMeterProvider())
+		otlpEndpoint, otlpProtocol, otlpInsecure, otlpInterval, topUpsTotal = oldEndpoint, oldProtocol, oldInsecure, oldInterval, oldTopUps
+	})
+	if err := setupOTel(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rpcDuration.observe(newLabels("method", "eth_call"), 0.02)
+
+	metrics := awaitExport(t, exports, "crypto_exporter_build_info", "crypto_rpc_duration_seconds")
+	if metrics["crypto_exporter_build_info"].GetGauge() == nil {
+		t.Errorf("crypto_exporter_build_info = %v, want a gauge", metrics["crypto_exporter_build_info"])
+	}
+	if metrics["crypto_rpc_duration_seconds"].GetHistogram() == nil {
+		t.Errorf("crypto_rpc_duration_seconds = %v, want a histogram", metrics["crypto_rpc_duration_seconds"])
+	}
+	for _, name := range []string{"crypto_rpc_duration_seconds_bucket", "crypto_rpc_duration_seconds_count"} {
+		if metrics[name] != nil {
+			t.Errorf("%s was exported along with the histogram", name)
+		}
+	}
+
+	//a metric first collected after setup gets an instrument too
+	topUpsTotal.inc(newLabels("name", "hot", "address", "0x5555555555555555555555555555555555555555", "symbol", "ETH", "result", "sent"))
+	metrics = awaitExport(t, exports, "crypto_top_ups_total")
+	sum := metrics["crypto_top_ups_total"].GetSum()
+	if sum == nil || !sum.IsMonotonic || len(sum.DataPoints) != 1 || sum.DataPoints[0].GetAsDouble() != 1 {
+		t.Fatalf("crypto_top_ups_total = %v, want a counter at 1", metrics["crypto_top_ups_total"])
+	}
+	attrs := map[string]string{}
+	for _, kv := range sum.DataPoints[0].Attributes {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	if attrs["name"] != "hot" || attrs["result"] != "sent" || len(attrs) != 4 {
+		t.Errorf("attributes = %v, want the labels", attrs)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// priceBatch is how many token contracts are asked for in one price request
+const priceBatch = 50
+
+var (
+	//prices are in fiatCurrency by token address, ETH being the zero address
+	prices   = map[common.Address]float64{}
+	pricesMu sync.Mutex
+)
+
+// priceLoop keeps the fiat prices of ETH and every token held by a watched wallet up to date
+func priceLoop(ctx context.Context) {
+	refreshPrices(ctx)
+	ticker := time.NewTicker(priceRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refreshPrices(ctx)
+		}
+	}
+}
+
+func refreshPrices(ctx context.Context) {
+	fresh := map[common.Address]float64{}
+	var eth map[string]map[string]float64
+	if err := getPrices(ctx, "/simple/price?ids=ethereum&vs_currencies="+url.QueryEscape(fiatCurrency), &eth); err != nil {
+		log.Errorf("Could not get ETH price: %s", err)
+	} else if p, ok := eth["ethereum"][fiatCurrency]; ok {
+		fresh[common.Address{}] = p
+	}
+	held := map[common.Address]bool{}
+	var tokens []string
+	for _, v := range watchedAddresses() {
+		for _, b := range v.balances {
+			if (b.token != TokenData{}) && !held[b.token.realAddress] {
+				held[b.token.realAddress] = true
+				tokens = append(tokens, strings.ToLower(b.token.realAddress.Hex()))
+			}
+		}
+	}
+	for i := 0; i < len(tokens); i += priceBatch {
+		batch := tokens[i:min(i+priceBatch, len(tokens))]
+		var found map[string]map[string]float64
+		err := getPrices(ctx, "/simple/token_price/ethereum?contract_addresses="+strings.Join(batch, ",")+"&vs_currencies="+url.QueryEscape(fiatCurrency), &found)
+		if err != nil {
+			log.Errorf("Could not get token prices: %s", err)
+			continue
+		}
+		for address, p := range found {
+			if price, ok := p[fiatCurrency]; ok {
+				fresh[common.HexToAddress(address)] = price
+			}
+		}
+	}
+	pricesMu.Lock()
+	defer pricesMu.Unlock()
+	//keep the last known price of anything that failed this time, rather than dropping it from the totals
+	for token, p := range fresh {
+		prices[token] = p
+	}
+}
+
+func getPrices(ctx context.Context, path string, result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(priceAPI, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("price api returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// price is the fiat price of a token (the zero address for ETH), if known
+func price(token common.Address) (float64, bool) {
+	pricesMu.Lock()
+	defer pricesMu.Unlock()
+	p, ok := prices[token]
+	return p, ok
+}
+
+// value is the fiat value of a balance, if it has an amount and a price
+func (b Balance) value() (float64, bool) {
+	if b.amount == nil {
+		return 0, false
+	}
+	p, ok := price(b.token.realAddress)
+	if !ok {
+		return 0, false
+	}
+	amount, _ := intToDec(b.amount, b.decimals()).Float64()
+	return amount * p, true
+}
+
+// priceMetrics adds the known fiat prices
+func priceMetrics(m *exposition) {
+	symbols := map[common.Address]string{{}: "ETH"}
+	for _, t := range currentTokens() {
+		symbols[t.realAddress] = t.Symbol
+	}
+	pricesMu.Lock()
+	defer pricesMu.Unlock()
+	for token, p := range prices {
+		m.add("crypto_price", newLabels("symbol", symbols[token], "address", token.Hex(), "currency", fiatCurrency), p)
+	}
+}
+
+// historicalPrice is the fiat price of a token (the zero address for ETH) closest to at
+func historicalPrice(ctx context.Context, token common.Address, at time.Time) (float64, bool) {
+	path := "/coins/ethereum/market_chart/range"
+	if token != (common.Address{}) {
+		path = "/coins/ethereum/contract/" + strings.ToLower(token.Hex()) + "/market_chart/range"
+	}
+	//a few hours either side is narrow enough to get the finest granularity the API has
+	path += fmt.Sprintf("?vs_currency=%s&from=%d&to=%d", url.QueryEscape(fiatCurrency), at.Add(-time.Hour*3).Unix(), at.Add(time.Hour*3).Unix())
+	var chart struct {
+		Prices [][2]float64 `json:"prices"`
+	}
+	if err := getPrices(ctx, path, &chart); err != nil {
+		log.Errorf("Could not get price of (%s) at %s: %s", token, at, err)
+		return 0, false
+	}
+	best, found := 0.0, false
+	var bestDistance float64
+	for _, p := range chart.Prices {
+		distance := math.Abs(p[0] - float64(at.UnixMilli()))
+		if !found || distance < bestDistance {
+			best, bestDistance, found = p[1], distance, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	probeCache   = map[string]probeResult{}
+	probeRunning = map[string]chan struct{}{}
+	probeCacheMu sync.Mutex
+	probeSlots   chan struct{}
+	//probeCtx outlives the scrapes that start probes, it is the server's base context so shutting down cancels them
+	probeCtx = context.Background()
+)
+
+// probeResult is a cached on-demand lookup of an address not (necessarily) in the static list
+type probeResult struct {
+	address  common.Address
+	balances []Balance
+	success  bool
+	failed   []string //symbols whose lookup failed
+	took     time.Duration
+	expires  time.Time
+}
+
+// handleProbe looks up balances of any address given in the query, like blackbox_exporter does for targets, so targets can be managed by prometheus service discovery
+func handleProbe(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	target := q.Get("address")
+	if target == "" {
+		http.Error(w, "address parameter is missing", http.StatusBadRequest)
+		return
+	}
+	if chain := q.Get("chain"); chain != "" && chain != "mainnet" {
+		http.Error(w, fmt.Sprintf("unsupported chain %q, only mainnet is supported", chain), http.StatusBadRequest)
+		return
+	}
+	filter := q["token"]
+	ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r))
+	defer cancel()
+
+	result, ok := watchedProbe(target, filter)
+	if !ok {
+		result = cachedProbe(ctx, target, filter)
+	}
+
+	m := newExposition()
+	for _, b := range result.balances {
+		if b.balance == "" {
+			continue
+		}
+		m.add("crypto_balance", newLabels("address", result.address.Hex(), "symbol", b.symbol), b.balance)
+	}
+	success := 0
+	if result.success {
+		success = 1
+	}
+	m.add("crypto_probe_success", nil, success)
+	m.add("crypto_probe_failed_lookups", nil, len(result.failed))
+	m.add("crypto_probe_duration_seconds", nil, fmt.Sprintf("%0.3f", result.took.Seconds()))
+	fmt.Fprintln(w, m)
+}
+
+// watchedProbe answers a probe of a watched address from the wallet loop, which already keeps its balances fresh
+func watchedProbe(target string, filter []string) (probeResult, bool) {
+	if len(filter) != 0 || !common.IsHexAddress(target) {
+		return probeResult{}, false
+	}
+	v, ok := findAddress(target)
+	if !ok {
+		return probeResult{}, false
+	}
+	result := probeResult{address: v.address, balances: v.balances, success: true}
+	for _, b := range v.balances {
+		if b.failing || b.stale {
+			result.success = false
+		}
+	}
+	return result, true
+}
+
+// cachedProbe returns the cached result for target, otherwise waits for a probe shared by every scrape of the same target.
+// The probe runs with its own timeout, so a scrape giving up early still leaves a result cached for the next one
+func cachedProbe(ctx context.Context, target string, filter []string) probeResult {
+	start := time.Now()
+	key := strings.ToLower(target) + "|" + strings.ToLower(strings.Join(sortedCopy(filter), ","))
+	probeCacheMu.Lock()
+	result, ok := probeCache[key]
+	if ok && time.Now().Before(result.expires) {
+		probeCacheMu.Unlock()
+		return result
+	}
+	done, running := probeRunning[key]
+	if !running {
+		done = make(chan struct{})
+		probeRunning[key] = done
+		go runProbe(key, target, filter, done)
+	}
+	probeCacheMu.Unlock()
+
+	select {
+	case <-done:
+		probeCacheMu.Lock()
+		defer probeCacheMu.Unlock()
+		return probeCache[key]
+	case <-ctx.Done():
+		return probeResult{took: time.Since(start)}
+	}
+}
+
+// runProbe probes target within probeTimeout and caches the result, failed or incomplete ones only for probeRetry
+func runProbe(key, target string, filter []string, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(probeCtx, probeTimeout)
+	defer cancel()
+	var result probeResult
+	select {
+	case probeSlots <- struct{}{}:
+		result = probe(ctx, target, filter)
+		<-probeSlots
+	case <-ctx.Done():
+		log.Errorf("Probe of (%s) timed out waiting for one of %d probe slots", target, cap(probeSlots))
+		result = probeResult{took: probeTimeout}
+	}
+	result.expires = time.Now().Add(probeCacheTTL)
+	if !result.success {
+		result.expires = time.Now().Add(min(probeRetry, probeCacheTTL))
+	}
+	probeCacheMu.Lock()
+	probeCache[key] = result
+	delete(probeRunning, key)
+	probeCacheMu.Unlock()
+	close(done)
+}
+
+// probe fetches ETH and token balances of target, limited to the tokens in filter (symbols or addresses) if any are given
+func probe(ctx context.Context, target string, filter []string) probeResult {
+	start := time.Now()
+	result := probeResult{}
+	if common.IsHexAddress(target) {
+		result.address = common.HexToAddress(target)
+	} else {
+		address, err := resolveENS(ctx, target)
+		if err != nil {
+			log.Errorf("Probe could not resolve (%s): %s", target, err)
+			result.took = time.Since(start)
+			return result
+		}
+		result.address = address
+	}
+	result.success = true
+	if len(filter) == 0 || matchesFilter(filter, "ETH", common.Address{}) {
+		eth := Balance{symbol: "ETH"}
+		//probes run outside the wallet loop, which owns lastBlock, so the block isn't known
+		eth.fetch(ctx, result.address, 0)
+		if eth.failing {
+			result.success = false
+			result.failed = append(result.failed, eth.symbol)
+		}
+		result.balances = append(result.balances, eth)
+	}
+	for _, token := range currentTokens() {
+		if len(filter) != 0 && !matchesFilter(filter, token.Symbol, token.realAddress) {
+			continue
+		}
+		bal, err := getTokenBalance(ctx, token, result.address)
+		if err != nil {
+			result.success = false
+			result.failed = append(result.failed, token.Symbol)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		//an explicitly requested token is reported even at zero
+		if bal.Sign() != 0 || len(filter) != 0 {
+			b := Balance{token: token, symbol: token.Symbol}
+			b.succeeded(bal, 0)
+			result.balances = append(result.balances, b)
+		}
+	}
+	result.took = time.Since(start)
+	return result
+}
+
+func matchesFilter(filter []string, symbol string, address common.Address) bool {
+	for _, f := range filter {
+		if strings.EqualFold(f, symbol) || (common.IsHexAddress(f) && common.HexToAddress(f) == address) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrapeTimeout uses the timeout prometheus sends with each scrape (minus some headroom), falling back to probeTimeout
+func scrapeTimeout(r *http.Request) time.Duration {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return probeTimeout
+	}
+	return time.Duration(seconds * 0.9 * float64(time.Second))
+}
+
+// cleanProbeCache drops expired probe results so arbitrary addresses don't pile up in memory
+func cleanProbeCache(ctx context.Context) {
+	ticker := time.NewTicker(probeCacheTTL + time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		probeCacheMu.Lock()
+		for k, v := range probeCache {
+			if time.Now().After(v.expires) {
+				delete(probeCache, k)
+			}
+		}
+		probeCacheMu.Unlock()
+	}
+}
+
+func sortedCopy(s []string) []string {
+	c := append([]string{}, s...)
+	sort.Strings(c)
+	return c
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+)
+
+var (
+	probeWallet = common.HexToAddress("0x5555555555555555555555555555555555555555")
+	probeUSDC   = TokenData{Symbol: "USDC", Decimals: 6, realAddress: common.HexToAddress("0x1111111111111111111111111111111111111111")}
+	probeDAI    = TokenData{Symbol: "DAI", Decimals: 18, realAddress: common.HexToAddress("0x2222222222222222222222222222222222222222")}
+)
+
+// withTokenNode is a JSON-RPC node holding 1.5 ETH and 1 of every token in tokens, failing the balanceOf calls of failing
+func withTokenNode(t *testing.T, tokens []TokenData, failing common.Address) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		switch req.Method {
+		case "eth_getBalance":
+			resp["result"] = hexutil.EncodeBig(ether(15))
+		case "eth_call":
+			var call struct {
+				To common.Address `json:"to"`
+			}
+			json.Unmarshal(req.Params[0], &call)
+			if call.To == failing {
+				resp["error"] = map[string]interface{}{"code": -32000, "message": "execution timeout"}
+			} else {
+				resp["result"] = hexutil.Bytes(math.U256Bytes(big.NewInt(1e6)))
+			}
+		default:
+			t.Errorf("unexpected call of %s", req.Method)
+			resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	oldClient, oldTokens := client, loadedTokens.Load()
+	client = newRPCPool([]string{server.URL}, "priority")
+	setTokenList(tokens)
+	t.Cleanup(func() {
+		client = oldClient
+		loadedTokens.Store(oldTokens)
+	})
+}
+
+func TestProbeFailsOnTokenError(t *testing.T) {
+	withTokenNode(t, []TokenData{probeUSDC, probeDAI}, probeDAI.realAddress)
+
+	result := probe(context.Background(), probeWallet.Hex(), nil)
+	if result.success {
+		t.Error("probe succeeded with the DAI lookup failing")
+	}
+	if len(result.failed) != 1 || result.failed[0] != "DAI" {
+		t.Errorf("failed = %v, want [DAI]", result.failed)
+	}
+	if len(result.balances) != 2 || result.balances[1].symbol != "USDC" {
+		t.Errorf("balances = %v, want ETH and USDC", result.balances)
+	}
+}
+
+func TestFailedProbeCachedForRetry(t *testing.T) {
+	withTokenNode(t, []TokenData{probeUSDC, probeDAI}, probeDAI.realAddress)
+	oldSlots, oldTTL, oldRetry, oldCache := probeSlots, probeCacheTTL, probeRetry, probeCache
+	probeSlots, probeCacheTTL, probeRetry, probeCache = make(chan struct{}, 1), time.Hour, time.Second*15, map[string]probeResult{}
+	t.Cleanup(func() {
+		probeSlots, probeCacheTTL, probeRetry, probeCache = oldSlots, oldTTL, oldRetry, oldCache
+	})
+
+	result := cachedProbe(context.Background(), probeWallet.Hex(), nil)
+	if left := time.Until(result.expires); left > probeRetry {
+		t.Errorf("incomplete probe cached for %s, want at most %s", left, probeRetry)
+	}
+}
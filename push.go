@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// permanentError is a write rejected by the receiver, sending it again would fail the same way
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// pushgatewaySink replaces the metrics of the job and instance on a pushgateway
+type pushgatewaySink struct {
+	url string
+}
+
+func (pushgatewaySink) Name() string {
+	return "pushgateway"
+}
+
+func (p pushgatewaySink) Write(ctx context.Context, snap snapshot) error {
+	u := strings.TrimRight(p.url, "/") + "/metrics/job/" + url.PathEscape(pushJob) + "/instance/" + url.PathEscape(pushInstance)
+	return pushRequest(ctx, http.MethodPut, u, []byte(snap.text), map[string]string{"Content-Type": "text/plain; version=0.0.4"})
+}
+
+// remoteWriteSink sends the metrics as a snappy compressed protobuf WriteRequest of the prometheus remote write protocol
+type remoteWriteSink struct {
+	url string
+}
+
+func (remoteWriteSink) Name() string {
+	return "remote_write"
+}
+
+func (r remoteWriteSink) Write(ctx context.Context, snap snapshot) error {
+	samples := make([]series, 0, len(snap.series))
+	for _, s := range snap.series {
+		labels := append(append(make([][2]string, 0, len(s.labels)+2), s.labels...), [2]string{"job", pushJob}, [2]string{"instance", pushInstance})
+		sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+		samples = append(samples, series{labels: labels, value: s.value})
+	}
+	body := snappy.Encode(nil, encodeWriteRequest(samples, snap.at.UnixMilli()))
+	return pushRequest(ctx, http.MethodPost, r.url, body, map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	})
+}
+
+func pushRequest(ctx context.Context, method, u string, body []byte, headers map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s returned %s: %s", u, resp.Status, bytes.TrimSpace(msg))
+	//client errors won't go away by sending the same thing again, apart from being rate limited
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest, every series having a single sample at timestamp (in milliseconds)
+func encodeWriteRequest(samples []series, timestamp int64) []byte {
+	var req []byte
+	for _, s := range samples {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l[1])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
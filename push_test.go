@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// receivedSeries is a time series decoded from a remote write request, with its only sample
+type receivedSeries struct {
+	labels    [][2]string
+	value     float64
+	timestamp int64
+}
+
+// consumeFields calls fn with every field of a protobuf message
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, field []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, typ, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func bytesField(field []byte) []byte {
+	v, _ := protowire.ConsumeBytes(field)
+	return v
+}
+
+// decodeWriteRequest decodes a prometheus.WriteRequest as a receiver would, independently of encodeWriteRequest
+func decodeWriteRequest(b []byte) ([]receivedSeries, error) {
+	var decoded []receivedSeries
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return fmt.Errorf("unexpected WriteRequest field %d", num)
+		}
+		var s receivedSeries
+		samples := 0
+		err := consumeFields(bytesField(field), func(num protowire.Number, typ protowire.Type, field []byte) error {
+			switch num {
+			case 1:
+				var label [2]string
+				err := consumeFields(bytesField(field), func(num protowire.Number, _ protowire.Type, field []byte) error {
+					label[num-1] = string(bytesField(field))
+					return nil
+				})
+				s.labels = append(s.labels, label)
+				return err
+			case 2:
+				samples++
+				return consumeFields(bytesField(field), func(num protowire.Number, _ protowire.Type, field []byte) error {
+					switch num {
+					case 1:
+						v, _ := protowire.ConsumeFixed64(field)
+						s.value = math.Float64frombits(v)
+					case 2:
+						v, _ := protowire.ConsumeVarint(field)
+						s.timestamp = int64(v)
+					}
+					return nil
+				})
+			}
+			return fmt.Errorf("unexpected TimeSeries field %d", num)
+		})
+		if samples != 1 {
+			return fmt.Errorf("series with %d samples", samples)
+		}
+		decoded = append(decoded, s)
+		return err
+	})
+	return decoded, err
+}
+
+// newRemoteWriteReceiver accepts remote writes, decoding each body onto received
+func newRemoteWriteReceiver(t *testing.T, received chan<- []receivedSeries) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" ||
+			r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected %s with headers %v", r.Method, r.Header)
+		}
+		compressed, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			t.Errorf("body isn't snappy compressed: %s", err)
+			return
+		}
+		decoded, err := decodeWriteRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			t.Errorf("body isn't a WriteRequest: %s", err)
+			return
+		}
+		received <- decoded
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRemoteWrite(t *testing.T) {
+	oldJob, oldInstance := pushJob, pushInstance
+	pushJob, pushInstance = "ethwallet", "exporter-0"
+	t.Cleanup(func() { pushJob, pushInstance = oldJob, oldInstance })
+
+	received := make(chan []receivedSeries, 1)
+	server := newRemoteWriteReceiver(t, received)
+	at := time.UnixMilli(1700000000123)
+	snap := snapshot{at: at, series: []series{
+		{labels: [][2]string{{"__name__", "crypto_balance"}, {"name", `cold "wallet"`}, {"address", "0xEA674fdDe714fd979de3EdF0F56AA9716B898ec8"}, {"symbol", "ETH"}}, value: 1.5},
+		{labels: [][2]string{{"__name__", "crypto_wallets"}}, value: 3},
+	}}
+	if err := (remoteWriteSink{url: server.URL}).Write(context.Background(), snap); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []receivedSeries{
+		{labels: [][2]string{{"__name__", "crypto_balance"}, {"address", "0xEA674fdDe714fd979de3EdF0F56AA9716B898ec8"}, {"instance", "exporter-0"}, {"job", "ethwallet"}, {"name", `cold "wallet"`}, {"symbol", "ETH"}}, value: 1.5, timestamp: at.UnixMilli()},
+		{labels: [][2]string{{"__name__", "crypto_wallets"}, {"instance", "exporter-0"}, {"job", "ethwallet"}}, value: 3, timestamp: at.UnixMilli()},
+	}
+	if got := <-received; !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want %v sorted by label name", got, want)
+	}
+}
+
+func TestPushRequestClassification(t *testing.T) {
+	tests := []struct {
+		status    int
+		ok        bool
+		permanent bool
+	}{
+		{http.StatusOK, true, false},
+		{http.StatusNoContent, true, false},
+		{http.StatusBadRequest, false, true},
+		{http.StatusUnauthorized, false, true},
+		{http.StatusNotFound, false, true},
+		{http.StatusTooManyRequests, false, false},
+		{http.StatusInternalServerError, false, false},
+		{http.StatusServiceUnavailable, false, false},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", tt.status)
+		}))
+		err := pushRequest(context.Background(), http.MethodPost, server.URL, []byte("x"), nil)
+		server.Close()
+		var permanent permanentError
+		if (err == nil) != tt.ok || errors.As(err, &permanent) != tt.permanent {
+			t.Errorf("status %d: err = %v, want ok %t and permanent %t", tt.status, err, tt.ok, tt.permanent)
+		}
+	}
+
+	//a receiver that can't be reached may come back, so is worth retrying
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	err := pushRequest(context.Background(), http.MethodPost, server.URL, nil, nil)
+	var permanent permanentError
+	if err == nil || errors.As(err, &permanent) {
+		t.Errorf("unreachable receiver: err = %v, want a retryable error", err)
+	}
+}
+
+func TestExpositionSeries(t *testing.T) {
+	name := "a \"quoted\" \\ name\nnext"
+	m := newExposition()
+	m.add("crypto_balance", newLabels("name", name, "symbol", "ETH"), "1.000000000000000001")
+	m.add("crypto_wallets", nil, 3)
+	m.add("crypto_balance", newLabels("name", "hot", "symbol", "ETH"), big.NewInt(2))
+
+	want := []series{
+		{labels: labelSet{{"__name__", "crypto_balance"}, {"name", name}, {"symbol", "ETH"}}, value: 1, text: "1.000000000000000001"},
+		{labels: labelSet{{"__name__", "crypto_balance"}, {"name", "hot"}, {"symbol", "ETH"}}, value: 2, text: "2"},
+		{labels: labelSet{{"__name__", "crypto_wallets"}}, value: 3, text: "3"},
+	}
+	if got := m.series(); !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v grouped by name with the labels as given", got, want)
+	}
+	wantText := `crypto_balance{name="a \"quoted\" \\ name\nnext",symbol="ETH"} 1.000000000000000001
+crypto_balance{name="hot",symbol="ETH"} 2
+crypto_wallets 3`
+	if got := m.String(); got != wantText {
+		t.Errorf("text = %q, want %q", got, wantText)
+	}
+}
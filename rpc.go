@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	neturl "net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var errNoEndpoints = errors.New("no healthy rpc endpoints available")
+
+// endpoint is a single geth RPC connection with its own circuit breaker
+type endpoint struct {
+	mu        sync.Mutex
+	url       string
+	label     string
+	rpc       *rpc.Client
+	client    *ethclient.Client
+	up        bool
+	latency   time.Duration
+	failures  uint
+	openUntil time.Time
+}
+
+// rpcPool spreads calls over one or more endpoints, failing over when an endpoint stops responding
+type rpcPool struct {
+	endpoints []*endpoint
+	strategy  string
+	next      uint32
+}
+
+// newRPCPool creates a pool for the given urls, endpoints that can't be dialled yet are retried by the health checks
+func newRPCPool(urls []string, strategy string) *rpcPool {
+	p := &rpcPool{strategy: strategy}
+	for _, u := range urls {
+		e := &endpoint{url: u, label: endpointLabel(u)}
+		e.dial()
+		p.endpoints = append(p.endpoints, e)
+	}
+	return p
+}
+
+// endpointLabel strips paths and credentials from an RPC url (infura/alchemy keys live there) so it's safe to export
+func endpointLabel(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (e *endpoint) dial() {
+	c, err := rpc.Dial(e.url)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		log.Errorf("Could not dial geth (%s): %s", e.label, err)
+		e.up = false
+		return
+	}
+	e.rpc = c
+	e.client = ethclient.NewClient(c)
+}
+
+// available returns the connection if the circuit breaker lets calls through to this endpoint, read under the lock as dial replaces it
+func (e *endpoint) available() (*rpc.Client, *ethclient.Client, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rpc, e.client, e.client != nil && !time.Now().Before(e.openUntil)
+}
+
+func (e *endpoint) success(latency time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.up && e.failures >= rpcBreakerThreshold {
+		log.Infof("RPC endpoint (%s) is back up", e.label)
+	}
+	e.up = true
+	e.latency = latency
+	e.failures = 0
+	e.openUntil = time.Time{}
+}
+
+// failure counts an error against the endpoint, opening the breaker with exponential backoff once rpcBreakerThreshold is reached
+func (e *endpoint) failure(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failures++
+	if e.failures < rpcBreakerThreshold {
+		return
+	}
+	backoff := rpcBackoff << (e.failures - rpcBreakerThreshold)
+	if backoff > rpcMaxBackoff || backoff <= 0 {
+		backoff = rpcMaxBackoff
+	}
+	if e.up {
+		log.Warnf("RPC endpoint (%s) marked down after %d failures: %s", e.label, e.failures, err)
+	}
+	e.up = false
+	e.openUntil = time.Now().Add(backoff)
+}
+
+// order returns endpoints in the order they should be tried for the next call
+func (p *rpcPool) order() []*endpoint {
+	if p.strategy != "round-robin" || len(p.endpoints) < 2 {
+		return p.endpoints
+	}
+	start := int(atomic.AddUint32(&p.next, 1)) % len(p.endpoints)
+	return append(append([]*endpoint{}, p.endpoints[start:]...), p.endpoints[:start]...)
+}
+
+// call runs fn against the first available endpoint, moving on to the next if the endpoint (not the request) failed, method is only used for metrics
+// fn should pass ctx on to the client where it can
+func (p *rpcPool) call(ctx context.Context, method string, fn func(*ethclient.Client) error) error {
+	return p.callEndpoint(ctx, method, func(_ *rpc.Client, c *ethclient.Client) error {
+		return fn(c)
+	})
+}
+
+// rawCall makes a JSON-RPC call with failover, for responses ethclient can't decode
+func (p *rpcPool) rawCall(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	return p.callEndpoint(ctx, method, func(r *rpc.Client, _ *ethclient.Client) error {
+		return r.CallContext(ctx, result, method, args...)
+	})
+}
+
+func (p *rpcPool) callEndpoint(ctx context.Context, method string, fn func(*rpc.Client, *ethclient.Client) error) (err error) {
+	_, span := tracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("rpc.method", method)))
+	defer func() { endSpan(span, err) }()
+	for _, e := range p.order() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, c, ok := e.available()
+		if !ok {
+			continue
+		}
+		start := time.Now()
+		err := fn(r, c)
+		took := time.Since(start)
+		rpcDuration.observe(newLabels("method", method), took.Seconds())
+		span.AddEvent("attempt", trace.WithAttributes(attribute.String("endpoint", e.label), attribute.Float64("duration_seconds", took.Seconds())))
+		if err == nil {
+			span.SetAttributes(attribute.String("endpoint", e.label))
+			e.success(took)
+			return nil
+		}
+		//the caller gave up, that isn't the endpoint's fault
+		if ctx.Err() != nil {
+			return err
+		}
+		if !isEndpointError(err) {
+			rpcErrors.inc(newLabels("method", method, "kind", "response"))
+			e.success(took)
+			return err
+		}
+		rpcErrors.inc(newLabels("method", method, "kind", "endpoint"))
+		e.failure(err)
+		log.Debugf("RPC endpoint (%s) failed, trying next: %s", e.label, err)
+	}
+	rpcErrors.inc(newLabels("method", method, "kind", "unavailable"))
+	return errNoEndpoints
+}
+
+// isEndpointError separates connection problems from errors the node answered with (reverts, bad calls), only the former should fail over
+func isEndpointError(err error) bool {
+	var netErr net.Error
+	var httpErr rpc.HTTPError
+	return errors.As(err, &netErr) ||
+		errors.As(err, &httpErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// healthLoop checks every endpoint, so ones that were marked down come back once they respond again
+func (p *rpcPool) healthLoop(ctx context.Context) {
+	p.checkHealth(ctx)
+	ticker := time.NewTicker(rpcHealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkHealth(ctx)
+		}
+	}
+}
+
+func (p *rpcPool) checkHealth(ctx context.Context) {
+	for _, e := range p.endpoints {
+		e.mu.Lock()
+		c := e.client
+		e.mu.Unlock()
+		if c == nil {
+			e.dial()
+			continue
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, rpcHealthInterval)
+		start := time.Now()
+		_, err := c.BlockNumber(checkCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		rpcDuration.observe(newLabels("method", "eth_blockNumber"), time.Since(start).Seconds())
+		if err != nil {
+			rpcErrors.inc(newLabels("method", "eth_blockNumber", "kind", "endpoint"))
+			e.failure(err)
+			continue
+		}
+		e.success(time.Since(start))
+	}
+}
+
+// endpointStatus is a snapshot of an endpoint's health for display
+type endpointStatus struct {
+	Label    string
+	Up       bool
+	Latency  time.Duration
+	Failures uint
+}
+
+func (p *rpcPool) status() []endpointStatus {
+	var status []endpointStatus
+	for _, e := range p.endpoints {
+		e.mu.Lock()
+		status = append(status, endpointStatus{Label: e.label, Up: e.up, Latency: e.latency.Round(time.Millisecond), Failures: e.failures})
+		e.mu.Unlock()
+	}
+	return status
+}
+
+// metrics adds the samples describing each endpoint, none before the pool is set up
+func (p *rpcPool) metrics(m *exposition) {
+	if p == nil {
+		return
+	}
+	for _, e := range p.endpoints {
+		e.mu.Lock()
+		up := 0
+		if e.up {
+			up = 1
+		}
+		labels := newLabels("endpoint", e.label)
+		m.add("crypto_rpc_endpoint_up", labels, up)
+		m.add("crypto_rpc_endpoint_latency_seconds", labels, fmt.Sprintf("%0.3f", e.latency.Seconds()))
+		e.mu.Unlock()
+	}
+}
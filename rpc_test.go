@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// rpcStandIn is a JSON-RPC node answering eth_blockNumber, unless told to be down (503) or to answer with an error
+type rpcStandIn struct {
+	*httptest.Server
+	calls   atomic.Int32
+	down    atomic.Bool
+	reverts atomic.Bool
+}
+
+func newRPCStandIn(t *testing.T) *rpcStandIn {
+	s := &rpcStandIn{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		if s.reverts.Load() {
+			resp["error"] = map[string]interface{}{"code": 3, "message": "execution reverted"}
+		} else {
+			resp["result"] = "0x10"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// withBreaker sets the breaker flags for a test
+func withBreaker(t *testing.T, threshold uint, backoff, maxBackoff time.Duration) {
+	oldThreshold, oldBackoff, oldMax := rpcBreakerThreshold, rpcBackoff, rpcMaxBackoff
+	rpcBreakerThreshold, rpcBackoff, rpcMaxBackoff = threshold, backoff, maxBackoff
+	t.Cleanup(func() {
+		rpcBreakerThreshold, rpcBackoff, rpcMaxBackoff = oldThreshold, oldBackoff, oldMax
+	})
+}
+
+func blockNumber(p *rpcPool) (uint64, error) {
+	ctx := context.Background()
+	var n uint64
+	err := p.call(ctx, "eth_blockNumber", func(c *ethclient.Client) (err error) {
+		n, err = c.BlockNumber(ctx)
+		return err
+	})
+	return n, err
+}
+
+func TestFailover(t *testing.T) {
+	withBreaker(t, 3, time.Second, time.Minute)
+	a, b := newRPCStandIn(t), newRPCStandIn(t)
+	a.down.Store(true)
+	p := newRPCPool([]string{a.URL, b.URL}, "priority")
+
+	n, err := blockNumber(p)
+	if err != nil || n != 16 {
+		t.Fatalf("blockNumber = %d, %v, want 16 from the second endpoint", n, err)
+	}
+	if a.calls.Load() != 1 || b.calls.Load() != 1 {
+		t.Errorf("calls = %d, %d, want 1, 1", a.calls.Load(), b.calls.Load())
+	}
+	if p.endpoints[0].failures != 1 {
+		t.Errorf("failures of the down endpoint = %d, want 1", p.endpoints[0].failures)
+	}
+}
+
+func TestResponseErrorsDontFailOver(t *testing.T) {
+	withBreaker(t, 1, time.Second, time.Minute)
+	a, b := newRPCStandIn(t), newRPCStandIn(t)
+	a.reverts.Store(true)
+	p := newRPCPool([]string{a.URL, b.URL}, "priority")
+
+	if _, err := blockNumber(p); err == nil {
+		t.Fatal("expected the node's error")
+	}
+	if b.calls.Load() != 0 {
+		t.Errorf("the second endpoint was called %d times, an answered error isn't the endpoint's fault", b.calls.Load())
+	}
+	if _, _, ok := p.endpoints[0].available(); !ok {
+		t.Error("an endpoint answering with errors was taken out of rotation")
+	}
+}
+
+func TestBreakerOpens(t *testing.T) {
+	withBreaker(t, 2, time.Minute, time.Hour)
+	a, b := newRPCStandIn(t), newRPCStandIn(t)
+	a.down.Store(true)
+	p := newRPCPool([]string{a.URL, b.URL}, "priority")
+
+	for i := 0; i < 4; i++ {
+		if _, err := blockNumber(p); err != nil {
+			t.Fatalf("call %d: %s", i, err)
+		}
+	}
+	if a.calls.Load() != 2 {
+		t.Errorf("the down endpoint was called %d times, want 2 before the breaker opened", a.calls.Load())
+	}
+	if _, _, ok := p.endpoints[0].available(); ok {
+		t.Error("breaker of the down endpoint is closed")
+	}
+
+	b.down.Store(true)
+	if _, err := blockNumber(p); !errors.Is(err, errNoEndpoints) {
+		t.Errorf("err = %v with every endpoint down, want %v", err, errNoEndpoints)
+	}
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	withBreaker(t, 2, time.Second, time.Second*4)
+	e := &endpoint{label: "test"}
+	down := errors.New("down")
+
+	e.failure(down)
+	if !e.openUntil.IsZero() {
+		t.Fatal("breaker opened before the threshold")
+	}
+	for _, want := range []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 4} {
+		e.failure(down)
+		if got := time.Until(e.openUntil); got > want || got < want-time.Second/2 {
+			t.Errorf("after %d failures the breaker is open for %s, want %s", e.failures, got, want)
+		}
+	}
+
+	e.success(time.Millisecond)
+	if e.failures != 0 || !e.openUntil.IsZero() || !e.up {
+		t.Errorf("success didn't reset the breaker: failures %d, open until %s, up %t", e.failures, e.openUntil, e.up)
+	}
+}
+
+func TestHealthCheckRecovers(t *testing.T) {
+	withBreaker(t, 1, time.Hour, time.Hour)
+	a := newRPCStandIn(t)
+	p := newRPCPool([]string{a.URL}, "priority")
+	if p.status()[0].Up {
+		t.Fatal("endpoint reported up before anything succeeded")
+	}
+
+	a.down.Store(true)
+	if _, err := blockNumber(p); err == nil {
+		t.Fatal("expected an error from the down endpoint")
+	}
+	if _, _, ok := p.endpoints[0].available(); ok {
+		t.Fatal("breaker didn't open")
+	}
+
+	a.down.Store(false)
+	p.checkHealth(context.Background())
+	if _, _, ok := p.endpoints[0].available(); !ok || !p.status()[0].Up {
+		t.Error("endpoint didn't come back after a successful health check")
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	withBreaker(t, 3, time.Second, time.Minute)
+	a, b := newRPCStandIn(t), newRPCStandIn(t)
+	p := newRPCPool([]string{a.URL, b.URL}, "round-robin")
+	for i := 0; i < 4; i++ {
+		if _, err := blockNumber(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a.calls.Load() != 2 || b.calls.Load() != 2 {
+		t.Errorf("calls = %d, %d, want them spread evenly", a.calls.Load(), b.calls.Load())
+	}
+}
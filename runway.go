@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	startTime = time.Now()
+	burns     = map[burnKey][]balanceDelta{}
+	burnsMu   sync.Mutex
+)
+
+type burnKey struct {
+	address common.Address
+	token   common.Address
+}
+
+// balanceDelta is an observed change of a balance, negative when it went down
+type balanceDelta struct {
+	at     time.Time
+	amount *big.Float
+}
+
+// recordBurn keeps the change from old for burn rate estimation, dropping changes older than runwayWindow
+func recordBurn(v Address, b *Balance, old *big.Int) {
+	delta := new(big.Int).Sub(b.amount, old)
+	if delta.Sign() > 0 && runwayExcludeTopUps {
+		return
+	}
+	key := burnKey{address: v.address, token: b.token.realAddress}
+	burnsMu.Lock()
+	defer burnsMu.Unlock()
+	deltas := append(burns[key], balanceDelta{at: b.lastSuccess, amount: intToDec(delta, b.decimals())})
+	cutoff := time.Now().Add(-runwayWindow)
+	for len(deltas) > 0 && deltas[0].at.Before(cutoff) {
+		deltas = deltas[1:]
+	}
+	burns[key] = deltas
+}
+
+// burnRate is how much of the balance is used per second over runwayWindow (or since startup if that's shorter), zero if it isn't going down.
+// It stays zero until changes were watched for runwayMinSpan, so a spend just after startup isn't taken as the rate of a whole window
+func burnRate(v Address, b Balance) float64 {
+	window := runwayWindow
+	if since := time.Since(startTime); since < window {
+		window = since
+	}
+	if window < runwayMinSpan {
+		return 0
+	}
+	cutoff := time.Now().Add(-window)
+	burnsMu.Lock()
+	defer burnsMu.Unlock()
+	total := new(big.Float)
+	for _, d := range burns[burnKey{address: v.address, token: b.token.realAddress}] {
+		if !d.at.Before(cutoff) {
+			total.Sub(total, d.amount)
+		}
+	}
+	burnt, _ := total.Float64()
+	if burnt <= 0 || window <= 0 {
+		return 0
+	}
+	return burnt / window.Seconds()
+}
+
+// runwayMetrics adds the burn rate and time until empty of each balance that is going down
+func runwayMetrics(m *exposition) {
+	for _, v := range watchedAddresses() {
+		for _, b := range v.balances {
+			if b.amount == nil {
+				continue
+			}
+			rate := burnRate(v, b)
+			if rate == 0 {
+				continue
+			}
+			labels := newLabels("name", v.name, "address", v.address.Hex(), "symbol", b.symbol)
+			balance, _ := intToDec(b.amount, b.decimals()).Float64()
+			m.add("crypto_balance_burn_rate_per_second", labels, rate)
+			m.add("crypto_balance_runway_seconds", labels, fmt.Sprintf("%0.0f", balance/rate))
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWarmStartedChangeIsNoBurn(t *testing.T) {
+	newFixtureNode(t)
+	oldList, oldStart, oldWindow, oldSpan := addressList, startTime, runwayWindow, runwayMinSpan
+	startTime, runwayWindow, runwayMinSpan = time.Now().Add(-time.Hour*2), time.Hour*24, time.Hour
+	t.Cleanup(func() {
+		addressList, startTime, runwayWindow, runwayMinSpan = oldList, oldStart, oldWindow, oldSpan
+		burnsMu.Lock()
+		burns = map[burnKey][]balanceDelta{}
+		burnsMu.Unlock()
+	})
+
+	//both were at 2 ETH and the node now says 1.5, one restored from state after a day down and one watched all along
+	restored := Address{name: "restored", address: common.HexToAddress("0x5555555555555555555555555555555555555555"),
+		balances: []Balance{{symbol: "ETH", amount: ether(20), lastSuccess: time.Now().Add(-time.Hour * 24), stale: true}}}
+	watched := Address{name: "watched", address: common.HexToAddress("0x7777777777777777777777777777777777777777"),
+		balances: []Balance{{symbol: "ETH", amount: ether(20), lastSuccess: time.Now().Add(-time.Minute)}}}
+	addressList = []Address{restored, watched}
+	refreshKnownBalances(context.Background())
+
+	if b := addressList[0].balances[0]; b.stale || b.amount.Cmp(ether(15)) != 0 {
+		t.Fatalf("restored balance = %s (stale %t), want a fresh 1.5 ETH", b.amount, b.stale)
+	}
+	if rate := burnRate(addressList[0], addressList[0].balances[0]); rate != 0 {
+		t.Errorf("burn rate = %g, want none from a change made while the exporter was down", rate)
+	}
+	if rate := burnRate(addressList[1], addressList[1].balances[0]); rate <= 0 {
+		t.Errorf("burn rate = %g, want the 0.5 ETH spent while watched", rate)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// sdTargetGroup is a target group of prometheus http_sd
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// handleSD serves prometheus http_sd targets, one /probe target per watched wallet so each can get its own scrape interval and relabeling
+func handleSD(w http.ResponseWriter, r *http.Request) {
+	target := sdTarget
+	if target == "" {
+		target = r.Host
+	}
+	memberOf := walletGroups()
+	list := watchedAddresses()
+	targets := make([]sdTargetGroup, 0, len(list))
+	for _, v := range list {
+		labels := map[string]string{
+			"__metrics_path__":         "/probe",
+			"__param_address":          v.address.Hex(),
+			"__param_chain":            "mainnet",
+			"__meta_ethwallet_name":    v.name,
+			"__meta_ethwallet_address": v.address.Hex(),
+			"__meta_ethwallet_chain":   "mainnet",
+		}
+		if v.ens != "" {
+			labels["__meta_ethwallet_ens"] = v.ens
+		}
+		//surrounded by commas like other service discoveries, so a group can be matched with .*,name,.*
+		if groups := memberOf[v.address.Hex()]; len(groups) > 0 {
+			labels["__meta_ethwallet_groups"] = "," + strings.Join(groups, ",") + ","
+		}
+		for k, value := range v.labels {
+			labels["__meta_ethwallet_label_"+k] = value
+		}
+		targets = append(targets, sdTargetGroup{Targets: []string{target}, Labels: labels})
+	}
+	writeJSON(w, http.StatusOK, targets)
+}
+
+// walletGroups lists the groups of each watched wallet by hex address
+func walletGroups() map[string][]string {
+	memberOf := map[string][]string{}
+	for _, name := range groupNames {
+		for _, member := range groups[name] {
+			for _, v := range memberAddresses(member) {
+				key := v.address.Hex()
+				if n := len(memberOf[key]); n == 0 || memberOf[key][n-1] != name {
+					memberOf[key] = append(memberOf[key], name)
+				}
+			}
+		}
+	}
+	for _, g := range memberOf {
+		sort.Strings(g)
+	}
+	return memberOf
+}
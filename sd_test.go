@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// discover serves /sd as requested on host
+func discover(t *testing.T, host string) []sdTargetGroup {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/sd", nil)
+	r.Host = host
+	handleSD(w, r)
+	var targets []sdTargetGroup
+	if err := json.NewDecoder(w.Body).Decode(&targets); err != nil {
+		t.Fatal(err)
+	}
+	return targets
+}
+
+func TestSDTargets(t *testing.T) {
+	vault := Address{name: "vault.eth", input: "vault.eth", ens: "vault.eth", address: common.HexToAddress("0x5555555555555555555555555555555555555555"), labels: map[string]string{"team": "treasury"}}
+	hot := Address{name: "hot", input: "0x7777777777777777777777777777777777777777", address: common.HexToAddress("0x7777777777777777777777777777777777777777")}
+	cold := Address{name: "cold", input: "0x9999999999999999999999999999999999999999", address: common.HexToAddress("0x9999999999999999999999999999999999999999")}
+	oldPublished, oldGroups, oldNames, oldTarget := published.Load(), groups, groupNames, sdTarget
+	published.Store(&refreshSnapshot{addresses: []Address{vault, hot, cold}})
+	//vault is listed twice in ops, by name and by address, and only gets the group once
+	groups = map[string][]string{"ops": {"vault.eth", vault.address.Hex(), "hot"}, "all": {"vault.eth", "hot", "cold"}}
+	groupNames = []string{"all", "ops"}
+	t.Cleanup(func() {
+		published.Store(oldPublished)
+		groups, groupNames, sdTarget = oldGroups, oldNames, oldTarget
+	})
+
+	sdTarget = ""
+	targets := discover(t, "exporter:9015")
+	want := []sdTargetGroup{
+		{Targets: []string{"exporter:9015"}, Labels: map[string]string{
+			"__metrics_path__":            "/probe",
+			"__param_address":             vault.address.Hex(),
+			"__param_chain":               "mainnet",
+			"__meta_ethwallet_name":       "vault.eth",
+			"__meta_ethwallet_address":    vault.address.Hex(),
+			"__meta_ethwallet_chain":      "mainnet",
+			"__meta_ethwallet_ens":        "vault.eth",
+			"__meta_ethwallet_groups":     ",all,ops,",
+			"__meta_ethwallet_label_team": "treasury",
+		}},
+		{Targets: []string{"exporter:9015"}, Labels: map[string]string{
+			"__metrics_path__":         "/probe",
+			"__param_address":          hot.address.Hex(),
+			"__param_chain":            "mainnet",
+			"__meta_ethwallet_name":    "hot",
+			"__meta_ethwallet_address": hot.address.Hex(),
+			"__meta_ethwallet_chain":   "mainnet",
+			"__meta_ethwallet_groups":  ",all,ops,",
+		}},
+		{Targets: []string{"exporter:9015"}, Labels: map[string]string{
+			"__metrics_path__":         "/probe",
+			"__param_address":          cold.address.Hex(),
+			"__param_chain":            "mainnet",
+			"__meta_ethwallet_name":    "cold",
+			"__meta_ethwallet_address": cold.address.Hex(),
+			"__meta_ethwallet_chain":   "mainnet",
+			"__meta_ethwallet_groups":  ",all,",
+		}},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("targets = %+v, want %+v", targets, want)
+	}
+
+	//an ungrouped wallet has no groups label rather than an empty one
+	groups, groupNames = nil, nil
+	if _, ok := discover(t, "exporter:9015")[2].Labels["__meta_ethwallet_groups"]; ok {
+		t.Error("ungrouped wallet has a groups label")
+	}
+
+	sdTarget = "ethwallet.internal:9015"
+	for _, g := range discover(t, "exporter:9015") {
+		if len(g.Targets) != 1 || g.Targets[0] != sdTarget {
+			t.Errorf("targets = %v, want the --sd-target", g.Targets)
+		}
+	}
+}
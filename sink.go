@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	sinks       []*queuedSink
+	sinkErrors  = newCounterVec()
+	sinkDropped = newCounterVec()
+
+	//sinkCtx is cancelled once flushSinks gives up, aborting writes still in flight
+	sinkCtx, stopSinks = context.WithCancel(context.Background())
+	//sinksClosed is set by flushSinks, sinksMu keeps writeSinks from queueing to a closed queue
+	sinksClosed bool
+	sinksMu     sync.Mutex
+)
+
+// Sink is somewhere the metrics are written to after every refresh, for what can't (or doesn't) scrape the exporter
+type Sink interface {
+	Name() string
+	// Write sends a snapshot, returning a permanentError if trying again won't help
+	Write(ctx context.Context, snap snapshot) error
+}
+
+// snapshot is the metrics of one refresh
+type snapshot struct {
+	at time.Time
+	// text is the prometheus text exposition format
+	text   string
+	series []series
+}
+
+// queuedSink writes snapshots to a sink in the background, retrying failures and queueing snapshots while it is down
+type queuedSink struct {
+	sink  Sink
+	queue chan snapshot
+	// done is closed once the queue is closed and drained
+	done chan struct{}
+}
+
+func setupSinks() {
+	if pushGateway != "" {
+		addSink(pushgatewaySink{url: pushGateway})
+	}
+	if remoteWrite != "" {
+		addSink(remoteWriteSink{url: remoteWrite})
+	}
+	if influxURL != "" {
+		s, err := newInfluxSink(influxURL, influxToken)
+		if err != nil {
+			log.Errorf("Could not set up InfluxDB (%s), continuing without it: %s", influxURL, err)
+		} else {
+			addSink(s)
+		}
+	}
+	if statsdAddress != "" {
+		s, err := newStatsdSink(statsdAddress, statsdFormat)
+		if err != nil {
+			log.Errorf("Could not set up statsd (%s), continuing without it: %s", statsdAddress, err)
+		} else {
+			addSink(s)
+		}
+	}
+}
+
+func addSink(s Sink) {
+	q := &queuedSink{sink: s, queue: make(chan snapshot, pushQueue), done: make(chan struct{})}
+	sinks = append(sinks, q)
+	go q.run(sinkCtx)
+	log.Infof("Writing metrics to %s after every refresh", s.Name())
+}
+
+// writeSinks queues the current metrics for every sink
+func writeSinks() {
+	if len(sinks) == 0 {
+		return
+	}
+	m := collectMetrics()
+	snap := snapshot{at: time.Now(), text: m.String() + "\n", series: m.series()}
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	if sinksClosed {
+		return
+	}
+	for _, q := range sinks {
+		q.enqueue(snap)
+	}
+}
+
+// enqueue adds a snapshot, dropping the oldest queued one when full as newer metrics are worth more
+func (q *queuedSink) enqueue(snap snapshot) {
+	for {
+		select {
+		case q.queue <- snap:
+			return
+		default:
+		}
+		select {
+		case <-q.queue:
+			sinkDropped.inc(newLabels("sink", q.sink.Name()))
+			log.Warnf("Queue of %s is full, dropped the oldest metrics", q.sink.Name())
+		default:
+		}
+	}
+}
+
+func (q *queuedSink) run(ctx context.Context) {
+	defer close(q.done)
+	for snap := range q.queue {
+		backoff := time.Second
+		for attempt := uint(0); ; attempt++ {
+			err := q.sink.Write(ctx, snap)
+			if err == nil {
+				break
+			}
+			sinkErrors.inc(newLabels("sink", q.sink.Name()))
+			var permanent permanentError
+			if errors.As(err, &permanent) || attempt >= pushRetries || ctx.Err() != nil {
+				sinkDropped.inc(newLabels("sink", q.sink.Name()))
+				log.Errorf("Could not write metrics to %s, dropping them: %s", q.sink.Name(), err)
+				break
+			}
+			log.Warnf("Could not write metrics to %s, retrying in %s: %s", q.sink.Name(), backoff, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// flushSinks writes what is still queued for every sink, giving up when ctx is done. Nothing can be written to the sinks after it
+func flushSinks(ctx context.Context) {
+	sinksMu.Lock()
+	sinksClosed = true
+	for _, q := range sinks {
+		close(q.queue)
+	}
+	sinksMu.Unlock()
+	for _, q := range sinks {
+		select {
+		case <-q.done:
+		case <-ctx.Done():
+			log.Warnf("Could not flush metrics to %s before shutting down, dropping them", q.sink.Name())
+		}
+	}
+	stopSinks()
+}
+
+// sinkSelfMetrics adds the sink error and drop counters
+func sinkSelfMetrics(m *exposition) {
+	sinkErrors.write(m, "crypto_sink_errors_total")
+	sinkDropped.write(m, "crypto_sink_dropped_total")
+}
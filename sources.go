@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	//staticAddresses are the --addresses (and group members), always watched whatever the sources say
+	staticAddresses []string
+	//addressEntries are the current entries of the address sources by input
+	addressEntries = map[string]addressEntry{}
+
+	invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+	//sourcesChanged is signalled when a watched address file changes
+	sourcesChanged = make(chan struct{}, 1)
+	sourceSettle   = time.Millisecond * 500
+)
+
+// addressEntry is an address input from an address source, with an optional name overriding the ENS or input and extra labels
+type addressEntry struct {
+	input  string
+	name   string
+	labels map[string]string
+}
+
+func hasAddressSources() bool {
+	return addressesFile != "" || addressesDir != "" || addressesURL != ""
+}
+
+// readAddressSources reads every configured source, failing if any of them fails so a broken source doesn't unwatch its addresses
+func readAddressSources(ctx context.Context) ([]addressEntry, error) {
+	var entries []addressEntry
+	if addressesFile != "" {
+		data, err := os.ReadFile(addressesFile)
+		if err != nil {
+			return nil, err
+		}
+		found, err := parseAddressEntries(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addressesFile, err)
+		}
+		entries = append(entries, found...)
+	}
+	if addressesDir != "" {
+		files, err := os.ReadDir(addressesDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			//configmap mounts keep their data in ..data style directories, the files themselves are symlinks to it
+			if strings.HasPrefix(f.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(addressesDir, f.Name())
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			found, err := parseAddressEntries(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			entries = append(entries, found...)
+		}
+	}
+	if addressesURL != "" {
+		data, err := fetchAddresses(ctx, addressesURL)
+		if err != nil {
+			return nil, err
+		}
+		found, err := parseAddressEntries(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", addressesURL, err)
+		}
+		entries = append(entries, found...)
+	}
+	return entries, nil
+}
+
+func fetchAddresses(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// parseAddressEntries reads one address (hex, ENS or extended key) per line, or CSV lines of "address,name,key=value;key=value".
+// Blank lines, # comments and an "address" header are skipped
+func parseAddressEntries(data []byte) ([]addressEntry, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []addressEntry
+	for i, record := range records {
+		input := strings.TrimSpace(record[0])
+		if input == "" || (i == 0 && strings.EqualFold(input, "address")) {
+			continue
+		}
+		entry := addressEntry{input: input}
+		if len(record) > 1 {
+			entry.name = strings.TrimSpace(record[1])
+		}
+		if len(record) > 2 && strings.TrimSpace(record[2]) != "" {
+			entry.labels = map[string]string{}
+			for _, label := range strings.Split(record[2], ";") {
+				key, value, ok := strings.Cut(label, "=")
+				if !ok {
+					return nil, fmt.Errorf("invalid label (%s) of %s, expected key=value", label, input)
+				}
+				entry.labels[invalidLabelChars.ReplaceAllString(strings.TrimSpace(key), "_")] = strings.TrimSpace(value)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// setAddressEntries makes entries the current source entries, returning every input to watch
+func setAddressEntries(entries []addressEntry) []string {
+	inputs := append([]string{}, staticAddresses...)
+	addressEntries = map[string]addressEntry{}
+	for _, e := range entries {
+		if _, ok := addressEntries[e.input]; !ok && !containsFold(staticAddresses, e.input) {
+			inputs = append(inputs, e.input)
+		}
+		addressEntries[e.input] = e
+	}
+	return inputs
+}
+
+// sourceInput is the input an address was parsed from, derived addresses belonging to their extended key
+func sourceInput(v Address) string {
+	if isExtendedKey(v.input) {
+		if i := strings.LastIndex(v.input, "/"); i > 0 {
+			return v.input[:i]
+		}
+	}
+	return v.input
+}
+
+// applyAddressEntries sets the names and labels of the address sources on the watched addresses
+func applyAddressEntries() {
+	for i, v := range addressList {
+		e, ok := addressEntries[sourceInput(v)]
+		if !ok {
+			continue
+		}
+		addressList[i].labels = e.labels
+		//derived addresses keep their own names, a single name would be shared by all of them
+		if e.name != "" && e.input == v.input {
+			addressList[i].name = e.name
+		}
+	}
+}
+
+// reloadAddresses re-reads the address sources, watching new addresses and dropping removed ones. It returns whether the watched set changed
+func reloadAddresses(ctx context.Context) bool {
+	entries, err := readAddressSources(ctx)
+	if err != nil {
+		log.Errorf("Could not reload address sources, keeping the current addresses: %s", err)
+		return false
+	}
+	inputs := setAddressEntries(entries)
+	wanted := make(map[string]bool, len(inputs))
+	for _, input := range inputs {
+		wanted[input] = true
+	}
+	watched := make(map[string]bool, len(rawAddresses))
+	for _, input := range rawAddresses {
+		watched[input] = true
+	}
+	var added []string
+	for _, input := range inputs {
+		if !watched[input] {
+			added = append(added, input)
+		}
+	}
+	kept := make([]Address, 0, len(addressList))
+	for _, v := range addressList {
+		if wanted[sourceInput(v)] {
+			kept = append(kept, v)
+		}
+	}
+	removed := len(addressList) - len(kept)
+	if len(added) == 0 && removed == 0 {
+		applyAddressEntries()
+		return false
+	}
+	kept = append(kept, parseAddresses(ctx, added)...)
+	for i := 0; i < len(derivations); i++ {
+		if !wanted[derivations[i].input] {
+			derivations = append(derivations[:i], derivations[i+1:]...)
+			i--
+		}
+	}
+	addressList = kept
+	rawAddresses = inputs
+	applyAddressEntries()
+	log.Infof("Address sources changed, watching %d new inputs %v and dropped %d addresses", len(added), added, removed)
+	return true
+}
+
+// sourceLabelPairs lists source labels as label_key, value pairs for labelString, sorted by key
+func sourceLabelPairs(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys)*2)
+	for _, k := range keys {
+		pairs = append(pairs, "label_"+k, labels[k])
+	}
+	return pairs
+}
+
+// watchAddressSources signals sourcesChanged when --addresses-file or --addresses-dir change, so the wallet loop reloads them
+// without waiting for --addresses-refresh. Events are coalesced over sourceSettle, as editors and ConfigMap updates each make several
+func watchAddressSources(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("Could not watch address sources, only re-reading them every %s: %s", addressesRefresh, err)
+		return
+	}
+	defer watcher.Close()
+	//the directory rather than the file, editors and ConfigMap updates replace files rather than writing to them
+	var dirs []string
+	if addressesFile != "" {
+		dirs = append(dirs, filepath.Dir(addressesFile))
+	}
+	if addressesDir != "" {
+		dirs = append(dirs, addressesDir)
+	}
+	for _, dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			log.Errorf("Could not watch (%s), only re-reading it every %s: %s", dir, addressesRefresh, err)
+		}
+	}
+	settle := time.NewTimer(sourceSettle)
+	settle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			log.Debugf("Address source changed: %s", event)
+			settle.Reset(sourceSettle)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("Could not watch address sources: %s", err)
+		case <-settle.C:
+			select {
+			case sourcesChanged <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withWatchedSources watches --addresses-dir dir and --addresses-file file until the test ends
+func withWatchedSources(t *testing.T, file, dir string) {
+	oldFile, oldDir, oldSettle := addressesFile, addressesDir, sourceSettle
+	addressesFile, addressesDir, sourceSettle = file, dir, time.Millisecond*50
+	//drain a signal left over by another test
+	select {
+	case <-sourcesChanged:
+	default:
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchAddressSources(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		addressesFile, addressesDir, sourceSettle = oldFile, oldDir, oldSettle
+	})
+	//let the watcher be set up before anything changes
+	time.Sleep(time.Millisecond * 50)
+}
+
+func awaitSourcesChanged(t *testing.T, what string) {
+	t.Helper()
+	select {
+	case <-sourcesChanged:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("no reload after %s", what)
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWatchConfigMapDir updates a directory the way the kubelet updates a mounted ConfigMap: the files are symlinks into
+// ..data, itself a symlink swapped to a new timestamped directory
+func TestWatchConfigMapDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, version := range []string{"..v1", "..v2"} {
+		if err := os.Mkdir(filepath.Join(dir, version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(dir, "..v1", "wallets.csv"), "0x5555555555555555555555555555555555555555,hot\n")
+	writeFile(t, filepath.Join(dir, "..v2", "wallets.csv"), "0x5555555555555555555555555555555555555555,hot\n0x7777777777777777777777777777777777777777,cold\n")
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", "wallets.csv"), filepath.Join(dir, "wallets.csv")); err != nil {
+		t.Fatal(err)
+	}
+	withWatchedSources(t, "", dir)
+
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	awaitSourcesChanged(t, "swapping ..data")
+
+	entries, err := readAddressSources(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].name != "cold" {
+		t.Errorf("read %v after the update, want both wallets", entries)
+	}
+}
+
+func TestWatchFileReplacedByEditor(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wallets.txt")
+	writeFile(t, path, "0x5555555555555555555555555555555555555555\n")
+	withWatchedSources(t, path, "")
+
+	//editors write a new file and rename it over the old one
+	writeFile(t, path+".swp", "0x7777777777777777777777777777777777777777\n")
+	if err := os.Rename(path+".swp", path); err != nil {
+		t.Fatal(err)
+	}
+	awaitSourcesChanged(t, "replacing the file")
+
+	//the events of one change are coalesced into a single reload
+	select {
+	case <-sourcesChanged:
+		t.Error("reloaded twice for one change")
+	case <-time.After(sourceSettle * 4):
+	}
+}
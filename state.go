@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	state *bolt.DB
+
+	addressesBucket   = []byte("addresses")
+	checkpointsBucket = []byte("checkpoints")
+)
+
+// storedAddress is how an Address (ENS resolution and discovered balances) is persisted between restarts
+type storedAddress struct {
+	Name      string          `json:"name"`
+	Address   common.Address  `json:"address"`
+	ENS       string          `json:"ens,omitempty"`
+	ENSExpiry time.Time       `json:"ensExpiry,omitempty"`
+	Balances  []storedBalance `json:"balances"`
+}
+
+type storedBalance struct {
+	Token       common.Address `json:"token"`
+	Symbol      string         `json:"symbol"`
+	Amount      string         `json:"amount,omitempty"`
+	LastSuccess time.Time      `json:"lastSuccess,omitempty"`
+	Block       uint64         `json:"block,omitempty"`
+}
+
+// openState opens (or creates) the embedded store at path
+func openState(path string) {
+	var err error
+	state, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		log.Errorf("Could not open state (%s), starting without it: %s", path, err)
+		state = nil
+		return
+	}
+	err = state.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{addressesBucket, checkpointsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Could not initialise state (%s), starting without it: %s", path, err)
+		state.Close()
+		state = nil
+	}
+}
+
+// loadAddresses restores persisted addresses for the given inputs, returning the inputs that weren't stored so they can be parsed
+func loadAddresses(inputs []string) ([]Address, []string) {
+	if state == nil {
+		return nil, inputs
+	}
+	var addresses []Address
+	var missing []string
+	err := state.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(addressesBucket)
+		for _, input := range inputs {
+			if isExtendedKey(input) {
+				derived, ok := loadDerived(bucket, input)
+				if !ok {
+					missing = append(missing, input)
+					continue
+				}
+				addresses = append(addresses, derived...)
+				continue
+			}
+			data := bucket.Get([]byte(input))
+			var stored storedAddress
+			if data == nil || json.Unmarshal(data, &stored) != nil {
+				missing = append(missing, input)
+				continue
+			}
+			addresses = append(addresses, stored.toAddress(input))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Could not load state: %s", err)
+		return nil, inputs
+	}
+	log.Infof("Warm started %d addresses from state", len(addresses))
+	return addresses, missing
+}
+
+// loadDerived restores the addresses derived from an extended key input, which are stored under "<input>/<index>".
+// The derivation continues after the last of them, unless they don't cover its starting range
+func loadDerived(bucket *bolt.Bucket, input string) ([]Address, bool) {
+	d, end, err := parseDerivation(input)
+	if err != nil {
+		return nil, false
+	}
+	stored := map[uint32]storedAddress{}
+	prefix := []byte(input + "/")
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		index, err := strconv.ParseUint(string(k[len(prefix):]), 10, 32)
+		if err != nil {
+			continue
+		}
+		var s storedAddress
+		if json.Unmarshal(v, &s) != nil {
+			continue
+		}
+		stored[uint32(index)] = s
+	}
+	var addresses []Address
+	for s, ok := stored[d.next]; ok; s, ok = stored[d.next] {
+		addresses = append(addresses, s.toAddress(fmt.Sprintf("%s/%d", input, d.next)))
+		d.next++
+	}
+	if d.next <= end {
+		return nil, false
+	}
+	addDerivation(d)
+	return addresses, true
+}
+
+// toAddress converts back to an Address, balances are marked stale until they are refreshed
+func (s storedAddress) toAddress(input string) Address {
+	list := currentTokens()
+	tokens := make(map[common.Address]TokenData, len(list))
+	for _, t := range list {
+		tokens[t.realAddress] = t
+	}
+	a := Address{name: s.Name, address: s.Address, input: input, ens: s.ENS, ensExpiry: s.ENSExpiry, scanned: true}
+	for _, sb := range s.Balances {
+		b := Balance{symbol: sb.Symbol, lastSuccess: sb.LastSuccess, block: sb.Block, stale: true}
+		if sb.Token != (common.Address{}) {
+			token, ok := tokens[sb.Token]
+			//no longer in the token list, the next full scan wouldn't find it either
+			if !ok {
+				continue
+			}
+			b.token = token
+		}
+		if amount, ok := new(big.Int).SetString(sb.Amount, 10); ok {
+			b.amount = amount
+			b.balance = intToDec(amount, b.decimals()).String()
+		}
+		a.balances = append(a.balances, b)
+	}
+	return a
+}
+
+// saveState persists the current addresses and balances
+func saveState() {
+	if state == nil {
+		return
+	}
+	err := state.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(addressesBucket)
+		for _, v := range addressList {
+			stored := storedAddress{Name: v.name, Address: v.address, ENS: v.ens, ENSExpiry: v.ensExpiry}
+			for _, b := range v.balances {
+				sb := storedBalance{Token: b.token.realAddress, Symbol: b.symbol, LastSuccess: b.lastSuccess, Block: b.block}
+				if b.amount != nil {
+					sb.Amount = b.amount.String()
+				}
+				stored.Balances = append(stored.Balances, sb)
+			}
+			data, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(v.input), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Could not save state: %s", err)
+	}
+}
+
+// closeState closes the embedded store, after which nothing more is persisted
+func closeState() {
+	if state == nil {
+		return
+	}
+	if err := state.Close(); err != nil {
+		log.Errorf("Could not close state: %s", err)
+	}
+	state = nil
+}
+
+// putCheckpoint records the last block processed by a log scanner in tx
+func putCheckpoint(tx *bolt.Tx, name string, block uint64) error {
+	return tx.Bucket(checkpointsBucket).Put([]byte(name), binary.BigEndian.AppendUint64(nil, block))
+}
+
+// loadCheckpoint gets the last block processed by a log scanner, if there is one
+func loadCheckpoint(name string) (block uint64, ok bool) {
+	if state == nil {
+		return 0, false
+	}
+	state.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(checkpointsBucket).Get([]byte(name))
+		if len(data) == 8 {
+			block, ok = binary.BigEndian.Uint64(data), true
+		}
+		return nil
+	})
+	return block, ok
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+// withState opens a new state in a temporary directory, returning its path so it can be reopened
+func withState(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "state.db")
+	oldState, oldAddresses, oldTokens, oldDerivations := state, addressList, loadedTokens.Load(), derivations
+	openState(path)
+	if state == nil {
+		t.Fatal("could not open state")
+	}
+	t.Cleanup(func() {
+		closeState()
+		state, addressList, derivations = oldState, oldAddresses, oldDerivations
+		loadedTokens.Store(oldTokens)
+	})
+	return path
+}
+
+// reopenState closes and reopens the state at path, as a restart would
+func reopenState(t *testing.T, path string) {
+	closeState()
+	openState(path)
+	if state == nil {
+		t.Fatal("could not reopen state")
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := withState(t)
+	setTokenList([]TokenData{probeUSDC, probeDAI})
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetched := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	eth := Balance{symbol: "ETH"}
+	eth.succeeded(ether(15), 16)
+	usdc := Balance{token: probeUSDC, symbol: "USDC"}
+	usdc.succeeded(big.NewInt(2500000), 16)
+	dai := Balance{token: probeDAI, symbol: "DAI"}
+	dai.succeeded(ether(10), 16)
+	for _, b := range []*Balance{&eth, &usdc, &dai} {
+		b.lastSuccess = fetched
+	}
+	wallet := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	addressList = []Address{{name: "vault.eth", input: wallet.Hex(), address: wallet, ens: "vault.eth", ensExpiry: expiry, balances: []Balance{eth, usdc, dai}, scanned: true}}
+	saveState()
+
+	//DAI was dropped from the token list while the exporter was down
+	reopenState(t, path)
+	setTokenList([]TokenData{probeUSDC})
+	loaded, missing := loadAddresses([]string{wallet.Hex(), "other.eth"})
+	if len(missing) != 1 || missing[0] != "other.eth" {
+		t.Errorf("missing = %v, want other.eth", missing)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("loaded %d addresses, want 1", len(loaded))
+	}
+	v := loaded[0]
+	if v.name != "vault.eth" || v.ens != "vault.eth" || !v.ensExpiry.Equal(expiry) || v.address != wallet || v.input != wallet.Hex() || !v.scanned {
+		t.Errorf("loaded %+v", v)
+	}
+	if len(v.balances) != 2 {
+		t.Fatalf("loaded balances %v, want ETH and USDC", v.balances)
+	}
+	for i, want := range []struct {
+		symbol, balance string
+	}{{"ETH", "1.5"}, {"USDC", "2.5"}} {
+		b := v.balances[i]
+		if b.symbol != want.symbol || b.balance != want.balance || b.block != 16 || !b.lastSuccess.Equal(fetched) || !b.stale {
+			t.Errorf("balance %d = %s %s at %d (%s, stale %t), want %s %s at 16 and stale", i, b.balance, b.symbol, b.block, b.lastSuccess, b.stale, want.balance, want.symbol)
+		}
+	}
+	if v.balances[1].decimals() != 6 {
+		t.Errorf("USDC restored with %d decimals, want the token's 6", v.balances[1].decimals())
+	}
+}
+
+func TestStateRestoresDerivations(t *testing.T) {
+	path := withState(t)
+	withGapLimit(t, 3)
+	d, end, err := parseDerivation(vectorParent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the range had been extended past the gap limit before the restart
+	addressList = d.derive(end + 2)
+	saveState()
+
+	reopenState(t, path)
+	derivations = nil
+	loaded, missing := loadAddresses([]string{vectorParent, vectorParent + "/0/{0-9}"})
+	if len(loaded) != 5 {
+		t.Errorf("loaded %d derived addresses, want all 5", len(loaded))
+	}
+	if len(derivations) != 1 || derivations[0].next != 5 {
+		t.Errorf("derivations = %v, want one continuing at 5", derivations)
+	}
+	//a derivation that was never stored is derived again
+	if len(missing) != 1 || missing[0] != vectorParent+"/0/{0-9}" {
+		t.Errorf("missing = %v, want the derivation that was never stored", missing)
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	path := withState(t)
+	if _, ok := loadCheckpoint("transfers"); ok {
+		t.Error("checkpoint found in a new state")
+	}
+	err := state.Update(func(tx *bolt.Tx) error {
+		return putCheckpoint(tx, "transfers", 19000000)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopenState(t, path)
+	if block, ok := loadCheckpoint("transfers"); !ok || block != 19000000 {
+		t.Errorf("checkpoint = %d (%t), want 19000000", block, ok)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// statsdPacketSize keeps packets under the usual MTU, so they aren't fragmented
+const statsdPacketSize = 1432
+
+// statsdEscaper replaces what separates names, values, types and tags in the statsd formats
+var statsdEscaper = strings.NewReplacer(",", "_", ":", "_", "|", "_", "=", "_", " ", "_", "#", "_")
+
+// statsdSink sends the metrics as statsd gauges over UDP, with the labels as DogStatsD tags or telegraf style statsd tags
+type statsdSink struct {
+	conn   net.Conn
+	format string
+}
+
+func newStatsdSink(address, format string) (*statsdSink, error) {
+	if format != "dogstatsd" && format != "statsd" {
+		return nil, fmt.Errorf("unknown statsd format %q", format)
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{conn: conn, format: format}, nil
+}
+
+func (s *statsdSink) Name() string {
+	return s.format
+}
+
+func (s *statsdSink) Write(ctx context.Context, snap snapshot) error {
+	var packet []byte
+	for _, series := range snap.series {
+		//statsd has no NaN or infinity
+		if math.IsNaN(series.value) || math.IsInf(series.value, 0) {
+			continue
+		}
+		line := s.line(series)
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdPacketSize {
+			if _, err := s.conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		_, err := s.conn.Write(packet)
+		return err
+	}
+	return nil
+}
+
+// line formats a gauge, "name:1|g|#key:value" for dogstatsd or "name,key=value:1|g" for statsd
+func (s *statsdSink) line(series series) string {
+	name := statsdEscaper.Replace(series.name())
+	value := strconv.FormatFloat(series.value, 'f', -1, 64)
+	tags := make([]string, 0, len(series.labels)-1)
+	for _, l := range series.labels[1:] {
+		if l[1] == "" {
+			continue
+		}
+		if s.format == "dogstatsd" {
+			tags = append(tags, statsdEscaper.Replace(l[0])+":"+statsdEscaper.Replace(l[1]))
+		} else {
+			tags = append(tags, statsdEscaper.Replace(l[0])+"="+statsdEscaper.Replace(l[1]))
+		}
+	}
+	if len(tags) == 0 {
+		return name + ":" + value + "|g"
+	}
+	if s.format == "dogstatsd" {
+		return name + ":" + value + "|g|#" + strings.Join(tags, ",")
+	}
+	return name + "," + strings.Join(tags, ",") + ":" + value + "|g"
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdLine(t *testing.T) {
+	balance := series{labels: labelSet{{"__name__", "crypto_balance"}, {"name", "cold wallet|a:b,c=d#e"}, {"ens", ""}, {"symbol", "ETH"}}, value: 1.5}
+	wallets := series{labels: labelSet{{"__name__", "crypto_wallets"}}, value: 3}
+	//names from recording rules can hold a colon, which would end the name
+	recorded := series{labels: labelSet{{"__name__", "job:crypto_balance:sum"}}, value: 0.000001}
+	for format, want := range map[string][]string{
+		"dogstatsd": {"crypto_balance:1.5|g|#name:cold_wallet_a_b_c_d_e,symbol:ETH", "crypto_wallets:3|g", "job_crypto_balance_sum:0.000001|g"},
+		"statsd":    {"crypto_balance,name=cold_wallet_a_b_c_d_e,symbol=ETH:1.5|g", "crypto_wallets:3|g", "job_crypto_balance_sum:0.000001|g"},
+	} {
+		s := &statsdSink{format: format}
+		for i, series := range []series{balance, wallets, recorded} {
+			if got := s.line(series); got != want[i] {
+				t.Errorf("%s: line = %q, want %q", format, got, want[i])
+			}
+		}
+	}
+}
+
+func TestStatsdWrite(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	s, err := newStatsdSink(listener.LocalAddr().String(), "dogstatsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//enough series to need two packets, along with one statsd can't represent
+	var all []series
+	for i := 0; i < 100; i++ {
+		all = append(all, series{labels: labelSet{{"__name__", "crypto_balance"}, {"symbol", strings.Repeat("X", 20)}}, value: float64(i)})
+	}
+	all = append(all, series{labels: labelSet{{"__name__", "crypto_balance_runway_seconds"}}, value: math.NaN()})
+	if err := s.Write(context.Background(), snapshot{series: all}); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	buf := make([]byte, 65536)
+	for packets := 0; len(lines) < 100; packets++ {
+		listener.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d lines in %d packets: %s", len(lines), packets, err)
+		}
+		if n > statsdPacketSize {
+			t.Errorf("packet of %d bytes, over %d", n, statsdPacketSize)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	if lines[99] != "crypto_balance:99|g|#symbol:"+strings.Repeat("X", 20) {
+		t.Errorf("last line = %q", lines[99])
+	}
+	listener.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if n, _, err := listener.ReadFrom(buf); err == nil {
+		t.Errorf("unexpected packet %q", buf[:n])
+	}
+}
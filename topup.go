@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	topUpKey    *ecdsa.PrivateKey
+	topUpFrom   common.Address
+	topUpAudit  *json.Encoder
+	topUpsTotal = newCounterVec()
+
+	topUpRules = map[string]topUpRule{}
+	lastTopUps = map[topUpTarget]time.Time{}
+	//sent holds what was sent per symbol on sentDay in its smallest unit, for the daily caps
+	sent    = map[string]*big.Int{}
+	sentDay string
+)
+
+// topUpRule is the amount sent per top up of a symbol and the most sent of it per day, in the symbol's smallest unit
+type topUpRule struct {
+	amount   *big.Int
+	cap      *big.Int
+	decimals uint8
+}
+
+// topUpTarget is a balance that can be topped up, its cooldown is kept per wallet and symbol
+type topUpTarget struct {
+	address common.Address
+	symbol  string
+}
+
+// topUpEntry is a line of the audit log, one per top up decision
+type topUpEntry struct {
+	Time          time.Time      `json:"time"`
+	Name          string         `json:"name"`
+	Address       common.Address `json:"address"`
+	Symbol        string         `json:"symbol"`
+	Amount        string         `json:"amount"`
+	RunwaySeconds float64        `json:"runwaySeconds"`
+	Result        string         `json:"result"`
+	Transaction   *common.Hash   `json:"transaction,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+// setupTopUps loads the funding key and opens the audit log
+func setupTopUps() error {
+	key, err := crypto.LoadECDSA(topUpKeyPath)
+	if err != nil {
+		return fmt.Errorf("could not load top up key (%s): %w", topUpKeyPath, err)
+	}
+	topUpKey = key
+	topUpFrom = crypto.PubkeyToAddress(key.PublicKey)
+	f, err := os.OpenFile(topUpAuditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open top up audit log (%s): %w", topUpAuditPath, err)
+	}
+	topUpAudit = json.NewEncoder(f)
+	log.Infof("Topping up wallets from %s (dry run: %t)", topUpFrom, topUpDryRun)
+	return nil
+}
+
+// loadTopUps works out the top up rules once the token list is known, then rebuilds the cooldowns and what was sent today from the audit log
+func loadTopUps() error {
+	rules, err := parseTopUpRules(topUpAmounts, topUpCaps, currentTokens())
+	if err != nil {
+		return err
+	}
+	topUpRules = rules
+	if err := loadTopUpAudit(topUpAuditPath); err != nil {
+		return fmt.Errorf("could not read top up audit log (%s): %w", topUpAuditPath, err)
+	}
+	return nil
+}
+
+// parseTopUpRules pairs each top up amount with its daily cap, both positive decimals with no more decimals than the symbol has
+func parseTopUpRules(amounts, caps map[string]string, tokens []TokenData) (map[string]topUpRule, error) {
+	rules := map[string]topUpRule{}
+	for symbol, raw := range amounts {
+		decimals, err := symbolDecimals(symbol, tokens)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := parseUnits(raw, decimals)
+		if err != nil || amount.Sign() <= 0 {
+			return nil, fmt.Errorf("top up amount of %s must be a positive number with at most %d decimals (%s)", symbol, decimals, raw)
+		}
+		rawCap, ok := caps[symbol]
+		if !ok {
+			return nil, fmt.Errorf("no daily top up cap for %s", symbol)
+		}
+		limit, err := parseUnits(rawCap, decimals)
+		if err != nil || limit.Sign() <= 0 {
+			return nil, fmt.Errorf("daily top up cap of %s must be a positive number with at most %d decimals (%s)", symbol, decimals, rawCap)
+		}
+		rules[symbol] = topUpRule{amount: amount, cap: limit, decimals: decimals}
+	}
+	return rules, nil
+}
+
+// symbolDecimals is the decimals of ETH or the token with symbol, which has to be in tokens and not be shared by tokens of other decimals
+func symbolDecimals(symbol string, tokens []TokenData) (uint8, error) {
+	if symbol == "ETH" {
+		return 18, nil
+	}
+	found := false
+	var decimals uint8
+	for _, t := range tokens {
+		if t.Symbol != symbol {
+			continue
+		}
+		if found && t.Decimals != decimals {
+			return 0, fmt.Errorf("tokens with the symbol %s have different decimals, it can't be topped up", symbol)
+		}
+		found, decimals = true, t.Decimals
+	}
+	if !found {
+		return 0, fmt.Errorf("%s is not in the token list, it can't be topped up", symbol)
+	}
+	return decimals, nil
+}
+
+// loadTopUpAudit replays the audit log, so a restart can't reset the cooldowns or let the funding key send a daily cap again
+func loadTopUpAudit(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	today := time.Now().UTC().Format("2006-01-02")
+	sent, sentDay = map[string]*big.Int{}, today
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry topUpEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			//a line cut short by a crash, the ones around it are still good
+			log.Errorf("Could not decode top up audit entry: %s", err)
+			continue
+		}
+		key := topUpTarget{address: entry.Address, symbol: entry.Symbol}
+		if entry.Time.After(lastTopUps[key]) {
+			lastTopUps[key] = entry.Time
+		}
+		//dry runs only count towards the caps of another dry run, they sent nothing
+		if entry.Time.UTC().Format("2006-01-02") != today || !(entry.Result == "sent" || (entry.Result == "dry-run" && topUpDryRun)) {
+			continue
+		}
+		//symbols no longer topped up have no cap to count towards
+		rule, ok := topUpRules[entry.Symbol]
+		if !ok {
+			continue
+		}
+		amount, err := parseUnits(entry.Amount, rule.decimals)
+		if err != nil {
+			log.Errorf("Could not parse top up audit amount (%s): %s", entry.Amount, err)
+			continue
+		}
+		sent[entry.Symbol] = new(big.Int).Add(sentToday(entry.Symbol), amount)
+	}
+	return scanner.Err()
+}
+
+// topUpWallets refills balances that will run out within topUpBelow, at most once per topUpCooldown and within the daily caps
+func topUpWallets(ctx context.Context) {
+	day := time.Now().UTC().Format("2006-01-02")
+	if day != sentDay {
+		sent = map[string]*big.Int{}
+		sentDay = day
+	}
+	for _, v := range addressList {
+		if v.address == topUpFrom {
+			continue
+		}
+		for _, b := range v.balances {
+			rule, ok := topUpRules[b.symbol]
+			if !ok || b.amount == nil || b.failing || b.stale {
+				continue
+			}
+			rate := burnRate(v, b)
+			if rate == 0 {
+				continue
+			}
+			balance, _ := intToDec(b.amount, b.decimals()).Float64()
+			runway := balance / rate
+			key := topUpTarget{address: v.address, symbol: b.symbol}
+			if runway >= topUpBelow.Seconds() || time.Since(lastTopUps[key]) < topUpCooldown {
+				continue
+			}
+			//failed and capped top ups wait out the cooldown too, rather than being retried every refresh
+			lastTopUps[key] = time.Now()
+			entry := topUpEntry{Time: time.Now(), Name: v.name, Address: v.address, Symbol: b.symbol, Amount: topUpAmounts[b.symbol], RunwaySeconds: runway}
+			total := new(big.Int).Add(rule.amount, sentToday(b.symbol))
+			if total.Cmp(rule.cap) > 0 {
+				entry.Result = "capped"
+				auditTopUp(entry)
+				continue
+			}
+			if topUpDryRun {
+				//dry runs count towards the caps, so the audit log shows what would really have been sent
+				sent[b.symbol] = total
+				entry.Result = "dry-run"
+				auditTopUp(entry)
+				continue
+			}
+			if b.decimals() != rule.decimals {
+				entry.Result, entry.Error = "failed", fmt.Sprintf("%s has %d decimals, the top up amount was worked out for %d", b.symbol, b.decimals(), rule.decimals)
+				auditTopUp(entry)
+				continue
+			}
+			hash, err := sendTopUp(ctx, v, b, rule.amount)
+			if err != nil {
+				entry.Result, entry.Error = "failed", err.Error()
+				auditTopUp(entry)
+				continue
+			}
+			sent[b.symbol] = total
+			entry.Result, entry.Transaction = "sent", &hash
+			auditTopUp(entry)
+		}
+	}
+}
+
+func sentToday(symbol string) *big.Int {
+	if s, ok := sent[symbol]; ok {
+		return s
+	}
+	return new(big.Int)
+}
+
+// sendTopUp sends amount of b's token (or ETH) from the funding key to v. The nonce is fixed up front, so a failover resending it can't pay twice
+func sendTopUp(ctx context.Context, v Address, b Balance, amount *big.Int) (common.Hash, error) {
+	var chainID *big.Int
+	var nonce uint64
+	err := client.call(ctx, "eth_chainId", func(c *ethclient.Client) (err error) {
+		chainID, err = c.ChainID(ctx)
+		return err
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	err = client.call(ctx, "eth_getTransactionCount", func(c *ethclient.Client) (err error) {
+		nonce, err = c.PendingNonceAt(ctx, topUpFrom)
+		return err
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	var tx *types.Transaction
+	err = client.call(ctx, "eth_sendRawTransaction", func(c *ethclient.Client) (err error) {
+		tx, err = transferTopUp(ctx, c, chainID, nonce, v.address, b.token, amount)
+		return err
+	})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return tx.Hash(), nil
+}
+
+// transferTopUp signs and sends amount of token (ETH if it's empty) from the funding key to to with the given nonce
+func transferTopUp(ctx context.Context, backend bind.ContractBackend, chainID *big.Int, nonce uint64, to common.Address, token TokenData, amount *big.Int) (*types.Transaction, error) {
+	opts, err := bind.NewKeyedTransactorWithChainID(topUpKey, chainID)
+	if err != nil {
+		return nil, err
+	}
+	opts.Context = ctx
+	opts.Nonce = new(big.Int).SetUint64(nonce)
+	if (token == TokenData{}) {
+		//a plain value transfer, the bound contract is only used for its fee handling. It refuses to estimate gas
+		//for an address without code, so the gas is estimated here, which also covers contract wallets
+		opts.Value = amount
+		opts.GasLimit, err = backend.EstimateGas(ctx, ethereum.CallMsg{From: opts.From, To: &to, Value: amount})
+		if err != nil {
+			return nil, err
+		}
+		return bind.NewBoundContract(to, abi.ABI{}, backend, backend, backend).Transfer(opts)
+	}
+	transactor, err := NewTokenTransactor(token.realAddress, backend)
+	if err != nil {
+		return nil, err
+	}
+	return transactor.Transfer(opts, to, amount)
+}
+
+func auditTopUp(entry topUpEntry) {
+	topUpsTotal.inc(newLabels("name", entry.Name, "address", entry.Address.Hex(), "symbol", entry.Symbol, "result", entry.Result))
+	if entry.Error != "" {
+		log.Errorf("Could not top up %s of (%s): %s", entry.Symbol, entry.Name, entry.Error)
+	} else {
+		log.Infof("Top up of %s %s to (%s): %s", entry.Amount, entry.Symbol, entry.Name, entry.Result)
+	}
+	if err := topUpAudit.Encode(entry); err != nil {
+		log.Errorf("Could not write top up audit log: %s", err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// testTokenCode is the runtime code of a bare token: transfer(to, amount) adds amount to to's balance and balanceOf(owner) reads it
+var testTokenCode = hexutil.MustDecode("0x600035" + "60e01c" + "80" + "63a9059cbb" + "14" + "601d57" + "6370a08231" + "14" + "603357" + "600080fd" +
+	"5b" + "600435" + "8054" + "602435" + "01" + "9055" + "600160005260206000f3" +
+	"5b" + "600435" + "54" + "60005260206000f3")
+
+var testToken = common.HexToAddress("0x00000000000000000000000000000000000070c3")
+
+// newSimulatedFunder sets a fresh funding key, funded on a simulated chain that also holds the test token
+func newSimulatedFunder(t *testing.T) *backends.SimulatedBackend {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, oldFrom := topUpKey, topUpFrom
+	topUpKey, topUpFrom = key, crypto.PubkeyToAddress(key.PublicKey)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		topUpFrom: {Balance: ether(100)},
+		testToken: {Code: testTokenCode, Balance: new(big.Int)},
+	}, 8_000_000)
+	t.Cleanup(func() {
+		sim.Close()
+		topUpKey, topUpFrom = oldKey, oldFrom
+	})
+	return sim
+}
+
+func TestTransferTopUpETH(t *testing.T) {
+	sim := newSimulatedFunder(t)
+	ctx := context.Background()
+	to := common.HexToAddress("0x5555555555555555555555555555555555555555")
+
+	for i, nonce := range []uint64{0, 1} {
+		if _, err := transferTopUp(ctx, sim, sim.Blockchain().Config().ChainID, nonce, to, TokenData{}, ether(5)); err != nil {
+			t.Fatalf("top up %d: %s", i, err)
+		}
+		sim.Commit()
+	}
+	balance, err := sim.BalanceAt(ctx, to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(ether(10)) != 0 {
+		t.Errorf("balance = %s, want %s", balance, ether(10))
+	}
+}
+
+func TestTransferTopUpResendingANonceDoesntPayTwice(t *testing.T) {
+	sim := newSimulatedFunder(t)
+	ctx := context.Background()
+	to := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	chainID := sim.Blockchain().Config().ChainID
+
+	if _, err := transferTopUp(ctx, sim, chainID, 0, to, TokenData{}, ether(5)); err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	//what a failover resending the top up does, the used nonce makes it fail
+	if _, err := transferTopUp(ctx, sim, chainID, 0, to, TokenData{}, ether(5)); err == nil {
+		t.Error("a top up was sent twice with the same nonce")
+	}
+	sim.Commit()
+	if balance, _ := sim.BalanceAt(ctx, to, nil); balance.Cmp(ether(5)) != 0 {
+		t.Errorf("balance = %s, want %s", balance, ether(5))
+	}
+}
+
+func TestTransferTopUpToken(t *testing.T) {
+	sim := newSimulatedFunder(t)
+	ctx := context.Background()
+	to := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	token := TokenData{Symbol: "TEST", Decimals: 6, realAddress: testToken}
+
+	tx, err := transferTopUp(ctx, sim, sim.Blockchain().Config().ChainID, 0, to, token, big.NewInt(1_000_000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.Commit()
+	if tx.Value().Sign() != 0 || *tx.To() != testToken {
+		t.Errorf("transaction sends %s to %s, want nothing to the token", tx.Value(), tx.To())
+	}
+	caller, err := NewTokenCaller(testToken, sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := caller.BalanceOf(nil, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance.Cmp(big.NewInt(1_000_000)) != 0 {
+		t.Errorf("token balance = %s, want 1000000", balance)
+	}
+}
+
+func TestParseTopUpRules(t *testing.T) {
+	tokens := []TokenData{{Symbol: "USDC", Decimals: 6}, {Symbol: "DAI", Decimals: 18}, {Symbol: "TWIN", Decimals: 6}, {Symbol: "TWIN", Decimals: 18}}
+	tests := []struct {
+		amounts, caps map[string]string
+		ok            bool
+	}{
+		{map[string]string{"ETH": "0.5", "USDC": "1000"}, map[string]string{"ETH": "2", "USDC": "5000"}, true},
+		{map[string]string{"ETH": "0.000000000000000001"}, map[string]string{"ETH": "2"}, true},
+		{map[string]string{"USDC": "0.000001"}, map[string]string{"USDC": "1"}, true},
+		{map[string]string{"ETH": "0.5"}, map[string]string{}, false},
+		{map[string]string{"ETH": "0"}, map[string]string{"ETH": "2"}, false},
+		{map[string]string{"ETH": "-1"}, map[string]string{"ETH": "2"}, false},
+		{map[string]string{"ETH": "lots"}, map[string]string{"ETH": "2"}, false},
+		{map[string]string{"ETH": "0.5"}, map[string]string{"ETH": "0"}, false},
+		{map[string]string{"ETH": "0.5"}, map[string]string{"ETH": "-2"}, false},
+		//big.Rat reads these, but they aren't amounts a transfer can be made of
+		{map[string]string{"ETH": "1/2"}, map[string]string{"ETH": "2"}, false},
+		{map[string]string{"ETH": "0.5"}, map[string]string{"ETH": "1/2"}, false},
+		{map[string]string{"ETH": "1e3"}, map[string]string{"ETH": "1e4"}, false},
+		{map[string]string{"ETH": "0.0000000000000000001"}, map[string]string{"ETH": "2"}, false},
+		{map[string]string{"USDC": "0.0000001"}, map[string]string{"USDC": "1"}, false},
+		{map[string]string{"USDC": "1"}, map[string]string{"USDC": "0.0000001"}, false},
+		{map[string]string{"NOPE": "1"}, map[string]string{"NOPE": "2"}, false},
+		{map[string]string{"TWIN": "1"}, map[string]string{"TWIN": "2"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := parseTopUpRules(tt.amounts, tt.caps, tokens); (err == nil) != tt.ok {
+			t.Errorf("parseTopUpRules(%v, %v) = %v, want ok %t", tt.amounts, tt.caps, err, tt.ok)
+		}
+	}
+
+	rules, err := parseTopUpRules(map[string]string{"USDC": "1000.5"}, map[string]string{"USDC": "5000"}, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rules["USDC"]; r.amount.Cmp(big.NewInt(1_000_500_000)) != 0 || r.cap.Cmp(big.NewInt(5_000_000_000)) != 0 || r.decimals != 6 {
+		t.Errorf("USDC rule = %s capped at %s with %d decimals, want 1000500000 capped at 5000000000 with 6", r.amount, r.cap, r.decimals)
+	}
+}
+
+// withTopUps sets up top ups of 1 ETH capped at 2 a day, from a key saved in a temporary directory and with the given audit log
+func withTopUps(t *testing.T, audit []topUpEntry) string {
+	dir := t.TempDir()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath, auditPath := filepath.Join(dir, "key.hex"), filepath.Join(dir, "audit.jsonl")
+	if err := crypto.SaveECDSA(keyPath, key); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	for _, entry := range audit {
+		enc.Encode(entry)
+	}
+	f.Close()
+
+	oldKeyPath, oldAuditPath, oldAmounts, oldCaps, oldDryRun := topUpKeyPath, topUpAuditPath, topUpAmounts, topUpCaps, topUpDryRun
+	oldBelow, oldCooldown, oldList := topUpBelow, topUpCooldown, addressList
+	oldStart, oldWindow, oldSpan := startTime, runwayWindow, runwayMinSpan
+	topUpKeyPath, topUpAuditPath = keyPath, auditPath
+	topUpAmounts, topUpCaps = map[string]string{"ETH": "1"}, map[string]string{"ETH": "2"}
+	topUpBelow, topUpCooldown = time.Hour*6, time.Hour
+	startTime, runwayWindow, runwayMinSpan = time.Now().Add(-time.Hour*2), time.Hour*24, time.Hour
+	lastTopUps, sent, sentDay = map[topUpTarget]time.Time{}, map[string]*big.Int{}, ""
+	t.Cleanup(func() {
+		topUpKeyPath, topUpAuditPath, topUpAmounts, topUpCaps, topUpDryRun = oldKeyPath, oldAuditPath, oldAmounts, oldCaps, oldDryRun
+		topUpBelow, topUpCooldown, addressList = oldBelow, oldCooldown, oldList
+		startTime, runwayWindow, runwayMinSpan = oldStart, oldWindow, oldSpan
+		lastTopUps, sent, sentDay = map[topUpTarget]time.Time{}, map[string]*big.Int{}, ""
+		burnsMu.Lock()
+		burns = map[burnKey][]balanceDelta{}
+		burnsMu.Unlock()
+	})
+	return auditPath
+}
+
+func readAudit(t *testing.T, path string) []topUpEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []topUpEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry topUpEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestTopUpAuditReplay(t *testing.T) {
+	wallet := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	now := time.Now()
+	withTopUps(t, []topUpEntry{
+		{Time: now.Add(-time.Hour * 48), Address: wallet, Symbol: "ETH", Amount: "5", Result: "sent"},
+		{Time: now.Add(-time.Minute * 10), Address: wallet, Symbol: "ETH", Amount: "1.5", Result: "sent"},
+		{Time: now.Add(-time.Minute * 5), Address: wallet, Symbol: "ETH", Amount: "1", Result: "dry-run"},
+		{Time: now.Add(-time.Minute), Address: wallet, Symbol: "ETH", Amount: "1", Result: "capped"},
+	})
+	if err := setupTopUps(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTopUps(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sentToday("ETH"); got.Cmp(ether(15)) != 0 {
+		t.Errorf("sent today = %s, want 1.5 ETH from the only send today", got)
+	}
+	if last := lastTopUps[topUpTarget{address: wallet, symbol: "ETH"}]; !last.Equal(now.Add(-time.Minute)) {
+		t.Errorf("last top up = %s, want the capped one a minute ago", last)
+	}
+
+	topUpDryRun = true
+	if err := setupTopUps(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTopUps(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sentToday("ETH"); got.Cmp(ether(25)) != 0 {
+		t.Errorf("sent today in a dry run = %s, want 2.5 ETH including the earlier dry run", got)
+	}
+}
+
+func TestTopUpCapsAndCooldownsSurviveRestart(t *testing.T) {
+	cooling := common.HexToAddress("0x5555555555555555555555555555555555555555")
+	other := common.HexToAddress("0x7777777777777777777777777777777777777777")
+	auditPath := withTopUps(t, []topUpEntry{
+		{Time: time.Now().Add(-time.Minute), Name: "cooling", Address: cooling, Symbol: "ETH", Amount: "1.5", Result: "sent"},
+	})
+	if err := setupTopUps(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTopUps(); err != nil {
+		t.Fatal(err)
+	}
+
+	//both wallets hold 0.1 ETH and spent 1 ETH in the last two hours, so are well under --top-up-below
+	addressList = nil
+	for _, a := range []struct {
+		name    string
+		address common.Address
+	}{{"cooling", cooling}, {"other", other}} {
+		v := Address{name: a.name, address: a.address, balances: []Balance{{symbol: "ETH", amount: ether(1)}}}
+		addressList = append(addressList, v)
+		burnsMu.Lock()
+		burns[burnKey{address: a.address}] = []balanceDelta{{at: time.Now().Add(-time.Minute * 30), amount: big.NewFloat(-1)}}
+		burnsMu.Unlock()
+	}
+
+	topUpWallets(context.Background())
+
+	entries := readAudit(t, auditPath)
+	if len(entries) != 2 {
+		t.Fatalf("got %d audit entries %v, want one more for the wallet not cooling down", len(entries), entries)
+	}
+	if e := entries[1]; e.Address != other || e.Result != "capped" {
+		t.Errorf("top up of %s was %s, want %s capped by what was sent before the restart", e.Address, e.Result, other)
+	}
+}
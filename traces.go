@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// callFrame is a call from geth's callTracer (debug_traceBlockByNumber)
+type callFrame struct {
+	Type  string          `json:"type"`
+	From  common.Address  `json:"from"`
+	To    *common.Address `json:"to"`
+	Value *hexutil.Big    `json:"value"`
+	Error string          `json:"error"`
+	Calls []callFrame     `json:"calls"`
+}
+
+// parityTrace is a trace from the parity style trace_block of erigon and nethermind
+type parityTrace struct {
+	Type   string `json:"type"`
+	Action struct {
+		CallType      string          `json:"callType"`
+		From          common.Address  `json:"from"`
+		To            *common.Address `json:"to"`
+		Value         *hexutil.Big    `json:"value"`
+		Address       common.Address  `json:"address"`
+		RefundAddress *common.Address `json:"refundAddress"`
+		Balance       *hexutil.Big    `json:"balance"`
+	} `json:"action"`
+	Result *struct {
+		Address *common.Address `json:"address"`
+	} `json:"result"`
+	Error               string       `json:"error"`
+	TraceAddress        []int        `json:"traceAddress"`
+	TransactionPosition *int         `json:"transactionPosition"`
+	TransactionHash     *common.Hash `json:"transactionHash"`
+}
+
+// internalMove is ETH moved by a contract, rather than by a transaction itself
+type internalMove struct {
+	from  common.Address
+	to    common.Address
+	value *big.Int
+}
+
+// scanInternalTransfers traces a block for ETH moved to or from watched wallets by contracts, which doesn't show up in transactions or logs
+func scanInternalTransfers(ctx context.Context, watched map[common.Address]Address, number uint64) ([]transfer, error) {
+	var moves []internalMove
+	var err error
+	switch traceAPI {
+	case "debug":
+		moves, err = debugInternalMoves(ctx, number)
+	case "parity":
+		moves, err = parityInternalMoves(ctx, number)
+	default:
+		return nil, fmt.Errorf("unknown trace api %q", traceAPI)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var transfers []transfer
+	for _, m := range moves {
+		if wallet, ok := watched[m.from]; ok {
+			transfers = append(transfers, transfer{wallet: wallet, direction: "out", symbol: "ETH", decimals: 18, amount: m.value})
+		}
+		if wallet, ok := watched[m.to]; ok {
+			transfers = append(transfers, transfer{wallet: wallet, direction: "in", symbol: "ETH", decimals: 18, amount: m.value})
+		}
+	}
+	return transfers, nil
+}
+
+func debugInternalMoves(ctx context.Context, number uint64) ([]internalMove, error) {
+	var txs []struct {
+		Result callFrame `json:"result"`
+	}
+	err := client.rawCall(ctx, &txs, "debug_traceBlockByNumber", hexutil.EncodeUint64(number), map[string]string{"tracer": "callTracer"})
+	if err != nil {
+		return nil, err
+	}
+	var moves []internalMove
+	for _, tx := range txs {
+		//the top level frame is the transaction, which scanNativeTransfers already counts
+		if tx.Result.Error != "" {
+			continue
+		}
+		for _, call := range tx.Result.Calls {
+			moves = appendCallMoves(moves, call)
+		}
+	}
+	return moves, nil
+}
+
+// appendCallMoves walks a call and its subcalls, skipping reverted frames along with everything they called
+func appendCallMoves(moves []internalMove, call callFrame) []internalMove {
+	if call.Error != "" {
+		return moves
+	}
+	switch call.Type {
+	case "CALL", "CREATE", "CREATE2", "SELFDESTRUCT":
+		if call.To != nil && call.Value != nil && call.Value.ToInt().Sign() > 0 {
+			moves = append(moves, internalMove{from: call.From, to: *call.To, value: call.Value.ToInt()})
+		}
+	}
+	for _, sub := range call.Calls {
+		moves = appendCallMoves(moves, sub)
+	}
+	return moves
+}
+
+func parityInternalMoves(ctx context.Context, number uint64) ([]internalMove, error) {
+	var traces []parityTrace
+	if err := client.rawCall(ctx, &traces, "trace_block", hexutil.EncodeUint64(number)); err != nil {
+		return nil, err
+	}
+	//trace addresses of failed frames per transaction, their subtraces were reverted too
+	failed := map[common.Hash][]string{}
+	var moves []internalMove
+	for _, t := range traces {
+		//block and uncle rewards have no transaction, and are already in the miner's balance
+		if t.TransactionHash == nil || t.TransactionPosition == nil {
+			continue
+		}
+		path := traceKey(t.TraceAddress)
+		if t.Error != "" {
+			failed[*t.TransactionHash] = append(failed[*t.TransactionHash], path)
+			continue
+		}
+		if len(t.TraceAddress) == 0 || revertedBy(failed[*t.TransactionHash], path) {
+			continue
+		}
+		switch {
+		case t.Type == "call" && t.Action.CallType == "call" && t.Action.To != nil && t.Action.Value != nil:
+			moves = appendMove(moves, t.Action.From, *t.Action.To, t.Action.Value)
+		case t.Type == "create" && t.Result != nil && t.Result.Address != nil && t.Action.Value != nil:
+			moves = appendMove(moves, t.Action.From, *t.Result.Address, t.Action.Value)
+		case t.Type == "suicide" && t.Action.RefundAddress != nil && t.Action.Balance != nil:
+			moves = appendMove(moves, t.Action.Address, *t.Action.RefundAddress, t.Action.Balance)
+		}
+	}
+	return moves, nil
+}
+
+func appendMove(moves []internalMove, from, to common.Address, value *hexutil.Big) []internalMove {
+	if value.ToInt().Sign() <= 0 {
+		return moves
+	}
+	return append(moves, internalMove{from: from, to: to, value: value.ToInt()})
+}
+
+// traceKey formats a trace address so it can be prefix matched, [0 1] becomes "0.1."
+func traceKey(traceAddress []int) string {
+	var b strings.Builder
+	for _, i := range traceAddress {
+		fmt.Fprintf(&b, "%d.", i)
+	}
+	return b.String()
+}
+
+func revertedBy(failed []string, path string) bool {
+	for _, f := range failed {
+		if strings.HasPrefix(path, f) {
+			return true
+		}
+	}
+	return false
+}
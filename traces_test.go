@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+var (
+	traceContract = common.HexToAddress("0xcccccccccccccccccccccccccccccccccccccccc")
+	traceWallet   = common.HexToAddress("0x5555555555555555555555555555555555555555")
+	traceCreated  = common.HexToAddress("0x9999999999999999999999999999999999999999")
+)
+
+// newFixtureNode is a JSON-RPC node answering each method with the result in testdata/<method>.json, counting the calls.
+// The fixtures are hand-written in the response format of each client (geth for debug_traceBlockByNumber, erigon/nethermind
+// for trace_block), not recorded from a node
+func newFixtureNode(t *testing.T) *atomic.Int32 {
+	calls := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := os.ReadFile(filepath.Join("testdata", req.Method+".json"))
+		if err != nil {
+			t.Errorf("no fixture for %s: %s", req.Method, err)
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": json.RawMessage(result)})
+	}))
+	t.Cleanup(server.Close)
+
+	oldClient, oldTraceAPI := client, traceAPI
+	client = newRPCPool([]string{server.URL}, "priority")
+	t.Cleanup(func() {
+		client, traceAPI = oldClient, oldTraceAPI
+	})
+	return calls
+}
+
+func ether(tenths int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(tenths), big.NewInt(1e17))
+}
+
+// both fixtures describe the same block: a payout to the wallet, a reverted frame and a failed transaction both paying it, and a contract created with value and destroyed to it
+func wantTraceMoves() []internalMove {
+	return []internalMove{
+		{from: traceContract, to: traceWallet, value: ether(5)},
+		{from: traceContract, to: traceCreated, value: ether(3)},
+		{from: traceCreated, to: traceWallet, value: ether(3)},
+	}
+}
+
+func checkMoves(t *testing.T, got, want []internalMove) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d moves %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if got[i].from != want[i].from || got[i].to != want[i].to || got[i].value.Cmp(want[i].value) != 0 {
+			t.Errorf("move %d = %s -> %s %s, want %s -> %s %s", i, got[i].from, got[i].to, got[i].value, want[i].from, want[i].to, want[i].value)
+		}
+	}
+}
+
+func TestDebugInternalMoves(t *testing.T) {
+	newFixtureNode(t)
+	moves, err := debugInternalMoves(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMoves(t, moves, wantTraceMoves())
+}
+
+func TestParityInternalMoves(t *testing.T) {
+	newFixtureNode(t)
+	moves, err := parityInternalMoves(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMoves(t, moves, wantTraceMoves())
+}
+
+func TestScanInternalTransfers(t *testing.T) {
+	newFixtureNode(t)
+	watched := map[common.Address]Address{traceWallet: {name: "wallet", address: traceWallet}}
+	for _, api := range []string{"debug", "parity"} {
+		traceAPI = api
+		transfers, err := scanInternalTransfers(context.Background(), watched, 1)
+		if err != nil {
+			t.Fatalf("%s: %s", api, err)
+		}
+		if len(transfers) != 2 {
+			t.Fatalf("%s: got %d transfers, want the payout and the refund", api, len(transfers))
+		}
+		for i, want := range []*big.Int{ether(5), ether(3)} {
+			if tr := transfers[i]; tr.direction != "in" || tr.symbol != "ETH" || tr.amount.Cmp(want) != 0 {
+				t.Errorf("%s: transfer %d = %s %s %s, want in %s ETH", api, i, tr.direction, tr.amount, tr.symbol, want)
+			}
+		}
+	}
+}
+
+func TestAppendCallMovesSkipsRevertedFrames(t *testing.T) {
+	to := traceWallet
+	value := func(tenths int64) *hexutil.Big { return (*hexutil.Big)(ether(tenths)) }
+	call := callFrame{Type: "CALL", From: traceContract, To: &to, Value: value(1), Calls: []callFrame{
+		{Type: "CALL", From: traceContract, To: &to, Value: value(2), Error: "execution reverted", Calls: []callFrame{
+			{Type: "CALL", From: traceContract, To: &to, Value: value(3)},
+		}},
+		{Type: "CALL", From: traceContract, To: &to, Value: value(4)},
+	}}
+	checkMoves(t, appendCallMoves(nil, call), []internalMove{
+		{from: traceContract, to: traceWallet, value: ether(1)},
+		{from: traceContract, to: traceWallet, value: ether(4)},
+	})
+}
+
+func TestRevertedBy(t *testing.T) {
+	tests := []struct {
+		failed []string
+		path   string
+		want   bool
+	}{
+		{nil, "0.", false},
+		{[]string{"1."}, "1.", true},
+		{[]string{"1."}, "1.0.", true},
+		{[]string{"1."}, "10.", false},
+		{[]string{"0.2."}, "0.2.3.", true},
+		{[]string{"0.2."}, "0.20.", false},
+		{[]string{"0.2."}, "0.", false},
+		{[]string{"3.", "0.1."}, "0.1.5.", true},
+	}
+	for _, tt := range tests {
+		if got := revertedBy(tt.failed, tt.path); got != tt.want {
+			t.Errorf("revertedBy(%v, %q) = %t, want %t", tt.failed, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"math/big"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+var (
+	transfersTotal = newCounterVec()
+	transferVolume = newCounterVec()
+
+	transferTopic = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+)
+
+// transfer is a movement of ETH or a token in or out of a watched wallet
+type transfer struct {
+	wallet    Address
+	direction string
+	symbol    string
+	decimals  uint8
+	amount    *big.Int
+}
+
+func (t transfer) count() {
+	labels := newLabels("name", t.wallet.name, "address", t.wallet.address.Hex(), "direction", t.direction, "symbol", t.symbol)
+	transfersTotal.inc(labels)
+	volume, _ := intToDec(t.amount, t.decimals).Float64()
+	transferVolume.add(labels, volume)
+}
+
+// scanTokenTransfers finds Transfer logs of tokens in the token list from or to watched wallets
+func scanTokenTransfers(ctx context.Context, watched map[common.Address]Address, from, to uint64) ([]transfer, error) {
+	list := currentTokens()
+	tokens := make(map[common.Address]TokenData, len(list))
+	for _, t := range list {
+		tokens[t.realAddress] = t
+	}
+	if len(watched) == 0 {
+		return nil, nil
+	}
+	var topics []common.Hash
+	for address := range watched {
+		topics = append(topics, common.BytesToHash(address.Bytes()))
+	}
+	parser, err := NewTokenFilterer(common.Address{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	//one query for each direction, as topics are and-ed
+	queries := []struct {
+		direction string
+		topics    [][]common.Hash
+	}{
+		{"out", [][]common.Hash{{transferTopic}, topics}},
+		{"in", [][]common.Hash{{transferTopic}, nil, topics}},
+	}
+	var transfers []transfer
+	for _, q := range queries {
+		var logs []types.Log
+		err := client.call(ctx, "eth_getLogs", func(c *ethclient.Client) (err error) {
+			logs, err = c.FilterLogs(ctx, ethereum.FilterQuery{FromBlock: new(big.Int).SetUint64(from), ToBlock: new(big.Int).SetUint64(to), Topics: q.topics})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range logs {
+			token, ok := tokens[l.Address]
+			//unknown (often spam) tokens, and ERC721 transfers which index the token id as a 4th topic
+			if !ok || len(l.Topics) != 3 || l.Removed {
+				continue
+			}
+			event, err := parser.ParseTransfer(l)
+			if err != nil {
+				continue
+			}
+			party := event.From
+			if q.direction == "in" {
+				party = event.To
+			}
+			if wallet, ok := watched[party]; ok {
+				transfers = append(transfers, transfer{wallet: wallet, direction: q.direction, symbol: token.Symbol, decimals: token.Decimals, amount: event.Tokens})
+			}
+		}
+	}
+	return transfers, nil
+}
+
+// scanNativeTransfers finds successful transactions moving ETH from or to watched wallets
+func scanNativeTransfers(ctx context.Context, watched map[common.Address]Address, block *rpcBlock) ([]transfer, error) {
+	var transfers []transfer
+	for _, tx := range block.Transactions {
+		if tx.Value == nil || tx.Value.ToInt().Sign() == 0 {
+			continue
+		}
+		sender, fromWatched := watched[tx.From]
+		var recipient Address
+		toWatched := false
+		if tx.To != nil {
+			recipient, toWatched = watched[*tx.To]
+		}
+		if !fromWatched && !toWatched {
+			continue
+		}
+		receipt, err := block.receipt(ctx, tx.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(receipt.Status) != types.ReceiptStatusSuccessful {
+			continue
+		}
+		if fromWatched {
+			transfers = append(transfers, transfer{wallet: sender, direction: "out", symbol: "ETH", decimals: 18, amount: tx.Value.ToInt()})
+		}
+		if toWatched {
+			transfers = append(transfers, transfer{wallet: recipient, direction: "in", symbol: "ETH", decimals: 18, amount: tx.Value.ToInt()})
+		}
+	}
+	return transfers, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var (
+	transferWallet  = Address{name: "hot", address: common.HexToAddress("0x5555555555555555555555555555555555555555")}
+	transferWallet2 = Address{name: "cold", address: common.HexToAddress("0x7777777777777777777777777777777777777777")}
+	transferOutside = common.HexToAddress("0x9999999999999999999999999999999999999999")
+)
+
+func transferLog(token, from, to common.Address, amount int64) types.Log {
+	return types.Log{
+		Address: token,
+		Topics:  []common.Hash{transferTopic, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())},
+		Data:    math.U256Bytes(big.NewInt(amount)),
+	}
+}
+
+// withLogNode is a node filtering logs by topic the way eth_getLogs does
+func withLogNode(t *testing.T, logs []types.Log) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params []struct {
+				Topics [][]common.Hash `json:"topics"`
+			} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "eth_getLogs" {
+			t.Errorf("unexpected call of %s (%v)", req.Method, err)
+			http.Error(w, "unexpected call", http.StatusBadRequest)
+			return
+		}
+		matched := []types.Log{}
+		for _, l := range logs {
+			match := true
+			for i, options := range req.Params[0].Topics {
+				if len(options) == 0 {
+					continue
+				}
+				found := false
+				for _, o := range options {
+					found = found || (i < len(l.Topics) && l.Topics[i] == o)
+				}
+				match = match && found
+			}
+			if match {
+				matched = append(matched, l)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": matched})
+	}))
+	t.Cleanup(server.Close)
+
+	oldClient, oldTokens := client, loadedTokens.Load()
+	client = newRPCPool([]string{server.URL}, "priority")
+	setTokenList([]TokenData{probeUSDC, probeDAI})
+	t.Cleanup(func() {
+		client = oldClient
+		loadedTokens.Store(oldTokens)
+	})
+}
+
+func describeTransfers(transfers []transfer) []string {
+	described := make([]string, len(transfers))
+	for i, t := range transfers {
+		described[i] = fmt.Sprintf("%s %s %s %s", t.wallet.name, t.direction, t.amount, t.symbol)
+	}
+	return described
+}
+
+func TestScanTokenTransfers(t *testing.T) {
+	nft := transferLog(probeUSDC.realAddress, transferWallet.address, transferOutside, 0)
+	nft.Topics = append(nft.Topics, common.BigToHash(big.NewInt(1)))
+	removed := transferLog(probeUSDC.realAddress, transferOutside, transferWallet.address, 7)
+	removed.Removed = true
+	approval := transferLog(probeUSDC.realAddress, transferWallet.address, transferOutside, 8)
+	approval.Topics[0] = common.HexToHash("0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925")
+	withLogNode(t, []types.Log{
+		transferLog(probeUSDC.realAddress, transferWallet.address, transferOutside, 5),
+		transferLog(probeUSDC.realAddress, transferOutside, transferWallet.address, 1),
+		transferLog(probeDAI.realAddress, transferWallet.address, transferWallet2.address, 2),
+		//a token outside the token list, usually spam
+		transferLog(common.HexToAddress("0xbad0000000000000000000000000000000000bad"), transferOutside, transferWallet.address, 3),
+		//nothing to do with the watched wallets
+		transferLog(probeUSDC.realAddress, transferOutside, transferOutside, 4),
+		nft,
+		removed,
+		approval,
+	})
+
+	watched := map[common.Address]Address{transferWallet.address: transferWallet, transferWallet2.address: transferWallet2}
+	transfers, err := scanTokenTransfers(context.Background(), watched, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"hot out 5 USDC", "hot out 2 DAI", "hot in 1 USDC", "cold in 2 DAI"}
+	if got := describeTransfers(transfers); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("transfers = %q, want %q", got, want)
+	}
+}
+
+func TestScanNativeTransfers(t *testing.T) {
+	tx := func(hash byte, from common.Address, to *common.Address, value int64) rpcTransaction {
+		return rpcTransaction{Hash: common.Hash{hash}, From: from, To: to, Value: (*hexutil.Big)(big.NewInt(value))}
+	}
+	outside := transferOutside
+	block := &rpcBlock{
+		Transactions: []rpcTransaction{
+			tx(1, transferWallet.address, &outside, 5),
+			tx(2, outside, &transferWallet.address, 1),
+			tx(3, transferWallet.address, &transferWallet2.address, 2),
+			//failed, so nothing moved
+			tx(4, outside, &transferWallet.address, 9),
+			//a contract call without value
+			tx(5, transferWallet.address, &outside, 0),
+			//a contract creation
+			tx(6, transferWallet.address, nil, 3),
+			tx(7, outside, &outside, 8),
+		},
+		receipts: map[common.Hash]*rpcReceipt{},
+	}
+	for i := byte(1); i <= 7; i++ {
+		block.receipts[common.Hash{i}] = &rpcReceipt{Status: hexutil.Uint64(types.ReceiptStatusSuccessful)}
+	}
+	block.receipts[common.Hash{4}].Status = hexutil.Uint64(types.ReceiptStatusFailed)
+
+	watched := map[common.Address]Address{transferWallet.address: transferWallet, transferWallet2.address: transferWallet2}
+	transfers, err := scanNativeTransfers(context.Background(), watched, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"hot out 5 ETH", "hot in 1 ETH", "hot out 2 ETH", "cold in 2 ETH", "hot out 3 ETH"}
+	if got := describeTransfers(transfers); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("transfers = %q, want %q", got, want)
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/ethclient"
 	log "github.com/sirupsen/logrus"
-	ens "github.com/wealdtech/go-ens/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TokenData keeps track of information one a specific token
@@ -25,94 +29,353 @@ type TokenData struct {
 
 // Address holds information of token balances of a wallet(address)
 type Address struct {
-	name     string
-	address  common.Address
+	name      string
+	address   common.Address
+	input     string
+	ens       string
+	ensExpiry time.Time
+	// labels are extra labels given by an address source
+	labels   map[string]string
 	balances []Balance
+	// scanErrors counts failed lookups of tokens not (yet) known to be held
+	scanErrors uint64
+	// scanned is set once all tokens have been scanned, after that newly found tokens are changes from zero
+	scanned bool
 }
 
-// Balance specifies the balance/amount of a token
+// Balance specifies the balance/amount of a token, balance is left empty until the first successful lookup
 type Balance struct {
-	balance string
-	token   TokenData
-	symbol  string
+	balance     string
+	amount      *big.Int
+	token       TokenData
+	symbol      string
+	failing     bool
+	lastSuccess time.Time
+	block       uint64
+	errors      uint64
+	// stale is set for balances restored from state until their first refresh
+	stale bool
+}
+
+// refreshSnapshot is what the wallet loop last published. Everything outside the loop reads this rather than addressList,
+// whose balances the loop keeps changing in place
+type refreshSnapshot struct {
+	addresses []Address
+	at        time.Time
+	took      time.Duration
+	block     uint64
+}
+
+var published atomic.Pointer[refreshSnapshot]
+
+// publishAddresses copies addressList and the refresh it came from for readers outside the wallet loop
+func publishAddresses() {
+	list := make([]Address, len(addressList))
+	for i, v := range addressList {
+		v.balances = append([]Balance(nil), v.balances...)
+		list[i] = v
+	}
+	published.Store(&refreshSnapshot{addresses: list, at: lastRefreshAt, took: lastRefresh, block: lastBlock})
+}
+
+// lastPublished is the last refresh published by the wallet loop, never to be modified
+func lastPublished() *refreshSnapshot {
+	if s := published.Load(); s != nil {
+		return s
+	}
+	return &refreshSnapshot{}
+}
+
+// watchedAddresses are the watched addresses as of the last refresh, never to be modified
+func watchedAddresses() []Address {
+	return lastPublished().addresses
 }
 
 // walletLoop runs every tick, scanning all tokens to check for every cacheTicks, and refreshes known balances every tick
-func walletLoop() {
+func walletLoop(ctx context.Context) {
 	var i uint = 0
-	refreshAllTokens()
-	for range time.Tick(refreshDuration) {
+	lastENSRefresh := time.Now()
+	lastAddressReload := time.Now()
+	if warmStarted {
+		//token sets and ENS names are already known, get fresh balances out quickly and re-resolve ENS on the next tick
+		refreshKnownBalances(ctx)
+		lastENSRefresh = time.Time{}
+	} else {
+		refreshAllTokens(ctx)
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if !warmStarted {
+		markReady()
+	}
+	refreshGasPrices(ctx)
+	saveState()
+	writeSinks()
+	ticker := time.NewTicker(refreshDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-sourcesChanged:
+			if !reloadAddresses(ctx) {
+				continue
+			}
+			lastAddressReload = time.Now()
+			//scan the tokens of new addresses now rather than after the cache runs out
+			i = cacheTicks
+		}
+		if ensRefresh > 0 && time.Since(lastENSRefresh) >= ensRefresh {
+			refreshENS(ctx)
+			applyAddressEntries()
+			lastENSRefresh = time.Now()
+		}
+		if hasAddressSources() && time.Since(lastAddressReload) >= addressesRefresh {
+			if reloadAddresses(ctx) {
+				//scan the tokens of new addresses now rather than after the cache runs out
+				i = cacheTicks
+			}
+			lastAddressReload = time.Now()
+		}
 		if i >= cacheTicks {
-			refreshAllTokens()
+			refreshAllTokens(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			markReady()
+			extendDerivations(ctx)
+			pruneHistory()
 			i = 0
 		} else {
-			refreshKnownBalances()
+			refreshKnownBalances(ctx)
 			i++
 		}
+		//shutting down, don't top up or save from a refresh that was cut short
+		if ctx.Err() != nil {
+			return
+		}
+		refreshGasPrices(ctx)
+		if topUpKey != nil {
+			topUpWallets(ctx)
+		}
+		saveState()
+		writeSinks()
 	}
 }
 
-func refreshKnownBalances() {
+func refreshKnownBalances(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "refresh known balances")
+	defer span.End()
 	start := time.Now()
+	updateBlockNumber(ctx)
 	total := 0
 	for i, v := range addressList {
-		for j, jv := range v.balances {
-			if (jv.token == TokenData{}) {
-				addressList[i].balances[j].balance = getEthBalance(v.address).String()
-			} else {
-				addressList[i].balances[j].balance = getTokenBalance(jv.token, v.address).String()
-			}
+		if ctx.Err() != nil {
+			return
+		}
+		for j := range v.balances {
+			b := &addressList[i].balances[j]
+			old := b.previousAmount()
+			b.fetch(ctx, v.address, lastBlock)
+			observeChange(v, b, old)
 		}
 		total += len(v.balances)
 	}
 	lastRefresh = time.Since(start)
+	lastRefreshAt = time.Now()
+	scanDuration.observe(newLabels("scan", "known"), lastRefresh.Seconds())
 	log.Infof("Refreshed %d addresses (%d balances) (%s)", len(addressList), total, lastRefresh)
+	publishAddresses()
 }
 
 // RefreshAllTokens checks all available tokens for non-zero balances
-func refreshAllTokens() {
+func refreshAllTokens(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "refresh all tokens")
+	defer span.End()
 	start := time.Now()
 	if len(addressList) < len(rawAddresses) {
-		log.Warn("Address list doesn't appear fully loaded, redailing geth")
-		connectClient()
-		addressList = parseAddresses(rawAddresses)
+		log.Warn("Address list doesn't appear fully loaded, re-parsing addresses")
+		addressList = parseAddresses(ctx, rawAddresses)
+		applyAddressEntries()
 	}
-	for i, v := range addressList {
-		addressList[i].balances = []Balance{{symbol: "ETH", balance: getEthBalance(v.address).String()}}
-		for _, jv := range tokenList {
-			bal := getTokenBalance(jv, v.address)
-			if bal.Cmp(big.NewFloat(0)) != 0 {
-				addressList[i].balances = append(addressList[i].balances, Balance{token: jv, symbol: jv.Symbol, balance: bal.String()})
-			}
+	updateBlockNumber(ctx)
+	for i := range addressList {
+		if ctx.Err() != nil {
+			return
 		}
+		scanAddress(ctx, i)
 	}
 	lastRefresh = time.Since(start)
-	log.Infof("Refreshed %d addresses and scanned for %d tokens (%s)", len(addressList), len(tokenList), lastRefresh)
+	lastRefreshAt = time.Now()
+	scanDuration.observe(newLabels("scan", "full"), lastRefresh.Seconds())
+	log.Infof("Refreshed %d addresses and scanned for %d tokens (%s)", len(addressList), len(currentTokens()), lastRefresh)
+	publishAddresses()
+}
+
+// scanAddress fetches ETH and checks every token for a non-zero balance of addressList[i]
+func scanAddress(ctx context.Context, i int) {
+	v := addressList[i]
+	//keyed by token address, ETH being the zero address
+	previous := make(map[common.Address]Balance, len(v.balances))
+	for _, b := range v.balances {
+		previous[b.token.realAddress] = b
+	}
+	eth := previous[common.Address{}]
+	eth.symbol = "ETH"
+	old := eth.previousAmount()
+	eth.fetch(ctx, v.address, lastBlock)
+	observeChange(v, &eth, old)
+	balances := []Balance{eth}
+	for _, jv := range currentTokens() {
+		b, known := previous[jv.realAddress]
+		bal, err := getTokenBalance(ctx, jv, v.address)
+		if err != nil {
+			//keep the last good value of known balances rather than dropping them
+			if known {
+				b.failed()
+				balances = append(balances, b)
+			} else {
+				addressList[i].scanErrors++
+			}
+			continue
+		}
+		old := b.previousAmount()
+		if !known && v.scanned {
+			old = new(big.Int)
+		}
+		b.token = jv
+		b.symbol = jv.Symbol
+		b.succeeded(bal, lastBlock)
+		observeChange(v, &b, old)
+		if bal.Sign() != 0 {
+			balances = append(balances, b)
+		}
+	}
+	addressList[i].balances = balances
+	addressList[i].scanned = true
 }
 
-func getEthBalance(address common.Address) *big.Float {
-	balance, err := client.BalanceAt(context.Background(), address, nil)
+// fetch refreshes the balance, keeping the last good value if the lookup fails
+func (b *Balance) fetch(ctx context.Context, address common.Address, block uint64) {
+	var bal *big.Int
+	var err error
+	if (b.token == TokenData{}) {
+		bal, err = getEthBalance(ctx, address)
+	} else {
+		bal, err = getTokenBalance(ctx, b.token, address)
+	}
 	if err != nil {
-		log.Errorf("Error fetching balance (%v)", address)
-		log.Info("Attempting to redail to geth...")
-		connectClient()
-		addressList = parseAddresses(rawAddresses)
+		b.failed()
+		return
+	}
+	b.succeeded(bal, block)
+}
+
+// succeeded records a fetched amount, block being the head it was fetched at (0 if unknown)
+func (b *Balance) succeeded(amount *big.Int, block uint64) {
+	b.amount = amount
+	b.balance = intToDec(amount, b.decimals()).String()
+	b.failing = false
+	b.stale = false
+	b.lastSuccess = time.Now()
+	b.block = block
+}
+
+// previousAmount is what a fresh lookup is compared against to see a change, nil for a balance restored from state
+// as it may have changed at any time while the exporter was down
+func (b *Balance) previousAmount() *big.Int {
+	if b.stale {
+		return nil
+	}
+	return b.amount
+}
+
+func (b *Balance) decimals() uint8 {
+	if (b.token == TokenData{}) {
+		return 18
 	}
-	return weiToEther(balance)
+	return b.token.Decimals
 }
 
-func getTokenBalance(token TokenData, address common.Address) *big.Float {
-	caller, err := NewTokenCaller(token.realAddress, client)
+// exact is the balance as a decimal string without float rounding, empty until the first successful lookup
+func (b *Balance) exact() string {
+	if b.amount == nil {
+		return ""
+	}
+	return formatUnits(b.amount, b.decimals())
+}
+
+func (b *Balance) failed() {
+	b.failing = true
+	b.errors++
+}
+
+// status summarises the fetch state, pending meaning there hasn't been a successful lookup yet
+func (b *Balance) status() string {
+	switch {
+	case b.failing:
+		return "failing"
+	case b.amount == nil:
+		return "pending"
+	case b.stale:
+		return "stale"
+	}
+	return "ok"
+}
+
+// updateBlockNumber records the head block balances are about to be fetched at
+func updateBlockNumber(ctx context.Context) {
+	err := client.call(ctx, "eth_blockNumber", func(c *ethclient.Client) (err error) {
+		lastBlock, err = c.BlockNumber(ctx)
+		return err
+	})
 	if err != nil {
-		fmt.Println("Err on token address: ", token.realAddress)
-		return big.NewFloat(0)
+		log.Errorf("Error fetching block number: %s", err)
 	}
-	balance, err := caller.BalanceOf(nil, address)
+}
+
+func getEthBalance(ctx context.Context, address common.Address) (*big.Int, error) {
+	return getEthBalanceAt(ctx, address, nil)
+}
+
+// getEthBalanceAt gets the ETH balance at block, nil being the latest block
+func getEthBalanceAt(ctx context.Context, address common.Address, block *big.Int) (balance *big.Int, err error) {
+	ctx, span := tracer.Start(ctx, "BalanceAt", trace.WithAttributes(attribute.String("address", address.Hex())))
+	defer func() { endSpan(span, err) }()
+	err = client.call(ctx, "eth_getBalance", func(c *ethclient.Client) (err error) {
+		balance, err = c.BalanceAt(ctx, address, block)
+		return err
+	})
+	if err != nil {
+		log.Errorf("Error fetching balance (%v): %s", address, err)
+		return nil, err
+	}
+	return balance, nil
+}
+
+func getTokenBalance(ctx context.Context, token TokenData, address common.Address) (*big.Int, error) {
+	return getTokenBalanceAt(ctx, token, address, nil)
+}
+
+// getTokenBalanceAt gets the token balance at block, nil being the latest block
+func getTokenBalanceAt(ctx context.Context, token TokenData, address common.Address, block *big.Int) (balance *big.Int, err error) {
+	ctx, span := tracer.Start(ctx, "BalanceOf", trace.WithAttributes(attribute.String("address", address.Hex()), attribute.String("token", token.Symbol), attribute.String("token.address", token.realAddress.Hex())))
+	defer func() { endSpan(span, err) }()
+	err = client.call(ctx, "balanceOf", func(c *ethclient.Client) error {
+		caller, err := NewTokenCaller(token.realAddress, c)
+		if err != nil {
+			return err
+		}
+		balance, err = caller.BalanceOf(&bind.CallOpts{Context: ctx, BlockNumber: block}, address)
+		return err
+	})
 	if err != nil {
 		log.Error("Err on token address: ", token.realAddress)
-		return big.NewFloat(0)
+		return nil, err
 	}
-	return intToDec(balance, token.Decimals)
+	return balance, nil
 }
 
 func intToDec(u *big.Int, decimal uint8) *big.Float {
@@ -120,30 +383,62 @@ func intToDec(u *big.Int, decimal uint8) *big.Float {
 		new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimal)), nil)))
 }
 
-func weiToEther(wei *big.Int) *big.Float {
-	return new(big.Float).Quo(new(big.Float).SetInt(wei), big.NewFloat(params.Ether))
+// formatUnits formats u with decimal places exactly, trimming trailing zeros
+func formatUnits(u *big.Int, decimal uint8) string {
+	digits := new(big.Int).Abs(u).String()
+	if len(digits) <= int(decimal) {
+		digits = strings.Repeat("0", int(decimal)-len(digits)+1) + digits
+	}
+	whole, frac := digits[:len(digits)-int(decimal)], strings.TrimRight(digits[len(digits)-int(decimal):], "0")
+	if frac != "" {
+		whole += "." + frac
+	}
+	if u.Sign() < 0 {
+		whole = "-" + whole
+	}
+	return whole
 }
 
-// parseAddresses converts address strings into Address structs, so we can handle hex wallets and ENS domains
-func parseAddresses(addressSlice []string) []Address {
+// parseUnits is the inverse of formatUnits, converting an exact decimal into base units
+func parseUnits(s string, decimal uint8) (*big.Int, error) {
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(frac) > int(decimal) {
+		return nil, fmt.Errorf("%s has more than %d decimals", s, decimal)
+	}
+	u, ok := new(big.Int).SetString(whole+frac+strings.Repeat("0", int(decimal)-len(frac)), 10)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a number", s)
+	}
+	return u, nil
+}
+
+// parseAddresses converts address strings into Address structs, so we can handle hex wallets, ENS domains and extended public keys
+func parseAddresses(ctx context.Context, addressSlice []string) []Address {
 	addresses := []Address{}
-	var name string
+	var name, ensName string
 	var address common.Address
 	var err error
 
 	for _, v := range addressSlice {
+		if isExtendedKey(v) {
+			addresses = append(addresses, deriveAddresses(ctx, v)...)
+			continue
+		}
 		if common.IsHexAddress(v) {
 			address = common.HexToAddress(v)
-			name, err = ens.ReverseResolve(client, address)
+			ensName, err = reverseResolve(ctx, address)
 			if err == nil {
-				log.Infof("Found ENS (%s) for address (%s)", name, address)
+				log.Infof("Found ENS (%s) for address (%s)", ensName, address)
+				name = ensName
 			} else {
+				log.Debugf("No verified ENS for address (%s): %s", address, err)
 				name = v
 			}
 		} else {
 			log.Infof("'%s' does not appear to be hex address attempting to resolve...", v)
 			name = v
-			address, err = ens.Resolve(client, v)
+			ensName = v
+			address, err = resolveENS(ctx, v)
 			//this might be weird cause many address potentially? for doge btc etc
 			if err != nil {
 				log.Error("ERROR: getting from ENS", err.Error())
@@ -152,7 +447,7 @@ func parseAddresses(addressSlice []string) []Address {
 			}
 			log.Infof("Name (%s) successfully resolved to address (%s)", v, address)
 		}
-		addresses = append(addresses, Address{name: name, address: address})
+		addresses = append(addresses, Address{name: name, address: address, input: v, ens: ensName, ensExpiry: lookupENSExpiry(ctx, ensName)})
 	}
 	return addresses
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// derivations are the extended keys being expanded into addresses, kept so the range can grow as addresses get used
+var derivations []*derivation
+
+// derivation expands an extended public key along a path template, "xpub.../0/{0-19}" deriving xpub.../0/0 to xpub.../0/19.
+// The key is usually the account level m/44'/60'/0', as hardened levels can't be derived from a public key
+type derivation struct {
+	input  string
+	prefix string
+	parent *hdkeychain.ExtendedKey
+	//next is the first index that hasn't been derived yet
+	next uint32
+}
+
+// isExtendedKey checks if an address input is an extended key rather than a hex address or ENS name
+func isExtendedKey(input string) bool {
+	for _, prefix := range []string{"xpub", "tpub", "xprv", "tprv"} {
+		if strings.HasPrefix(input, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDerivation splits "key[/path...][/{start-end}]" into a derivation starting at start, returning the end of the range.
+// Without a range the first xpubGapLimit addresses are derived, without a path the external chain (0) is used
+func parseDerivation(input string) (*derivation, uint32, error) {
+	parts := strings.Split(input, "/")
+	key, err := hdkeychain.NewKeyFromString(parts[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	if key.IsPrivate() {
+		return nil, 0, fmt.Errorf("private extended keys aren't accepted, give the xpub instead")
+	}
+	path := parts[1:]
+	start, end := uint32(0), uint32(xpubGapLimit)
+	if n := len(path); n > 0 && strings.HasPrefix(path[n-1], "{") {
+		from, to, ok := strings.Cut(strings.Trim(path[n-1], "{}"), "-")
+		s, errStart := strconv.ParseUint(from, 10, 31)
+		e, errEnd := strconv.ParseUint(to, 10, 31)
+		if !ok || errStart != nil || errEnd != nil || e < s {
+			return nil, 0, fmt.Errorf("invalid range %s, expected {start-end}", path[n-1])
+		}
+		start, end = uint32(s), uint32(e)+1
+		path = path[:n-1]
+	}
+	if end == 0 {
+		return nil, 0, fmt.Errorf("no range given and --xpub-gap-limit is 0")
+	}
+	end--
+	if len(path) == 0 {
+		path = []string{"0"}
+	}
+	for _, p := range path {
+		i, err := strconv.ParseUint(p, 10, 31)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid path level %s, hardened levels can't be derived from an xpub", p)
+		}
+		if key, err = key.Derive(uint32(i)); err != nil {
+			return nil, 0, err
+		}
+	}
+	//names are kept short enough for labels, the full key is still the input
+	prefix := parts[0][:12] + ".../" + strings.Join(path, "/")
+	return &derivation{input: input, prefix: prefix, parent: key, next: start}, end, nil
+}
+
+// derive adds addresses up to and including index end
+func (d *derivation) derive(end uint32) []Address {
+	var addresses []Address
+	for ; d.next <= end; d.next++ {
+		child, err := d.parent.Derive(d.next)
+		if err != nil {
+			//an invalid child is astronomically unlikely, BIP-32 says to skip it
+			log.Warnf("Skipping index %d of (%s): %s", d.next, d.prefix, err)
+			continue
+		}
+		pub, err := child.ECPubKey()
+		if err != nil {
+			log.Errorf("Could not get public key of index %d of (%s): %s", d.next, d.prefix, err)
+			continue
+		}
+		addresses = append(addresses, Address{
+			name:    fmt.Sprintf("%s/%d", d.prefix, d.next),
+			address: crypto.PubkeyToAddress(*pub.ToECDSA()),
+			input:   fmt.Sprintf("%s/%d", d.input, d.next),
+		})
+	}
+	return addresses
+}
+
+// deriveAddresses expands an extended key input, growing the range while any of the last xpubGapLimit addresses has been used
+func deriveAddresses(ctx context.Context, input string) []Address {
+	d, end, err := parseDerivation(input)
+	if err != nil {
+		//never log the whole input, it could be a private key
+		log.Errorf("ERR: Extended key (%s...) could not be parsed: %s", input[:min(len(input), 12)], err)
+		return nil
+	}
+	addresses := d.derive(end)
+	for xpubGapLimit > 0 && len(addresses) > 0 {
+		last := addresses[max(0, len(addresses)-int(xpubGapLimit)):]
+		if !anyActive(ctx, last) {
+			break
+		}
+		addresses = append(addresses, d.derive(d.next+uint32(xpubGapLimit)-1)...)
+	}
+	log.Infof("Derived %d addresses from (%s)", len(addresses), d.prefix)
+	addDerivation(d)
+	return addresses
+}
+
+// addDerivation keeps d so its range can grow, replacing an earlier derivation of the same input
+func addDerivation(d *derivation) {
+	for i, existing := range derivations {
+		if existing.input == d.input {
+			derivations[i] = d
+			return
+		}
+	}
+	derivations = append(derivations, d)
+}
+
+// anyActive checks if any address has sent a transaction or holds ETH, before their balances are scanned
+func anyActive(ctx context.Context, addresses []Address) bool {
+	for _, v := range addresses {
+		var nonce uint64
+		err := client.call(ctx, "eth_getTransactionCount", func(c *ethclient.Client) (err error) {
+			nonce, err = c.NonceAt(ctx, v.address, nil)
+			return err
+		})
+		if err != nil {
+			log.Errorf("Could not check activity of (%s): %s", v.name, err)
+			continue
+		}
+		if nonce > 0 {
+			return true
+		}
+		balance, err := getEthBalance(ctx, v.address)
+		if err != nil {
+			log.Errorf("Could not check activity of (%s): %s", v.name, err)
+			continue
+		}
+		if balance.Sign() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// extendDerivations grows the range of every derivation whose last xpubGapLimit addresses were used, going by the balances of the last full scan
+// and, if none of them hold anything, whether any has sent a transaction
+func extendDerivations(ctx context.Context) {
+	if xpubGapLimit == 0 {
+		return
+	}
+	for _, d := range derivations {
+		var gap []Address
+		held := false
+		for _, v := range addressList {
+			if !strings.HasPrefix(v.input, d.input+"/") {
+				continue
+			}
+			index, err := strconv.ParseUint(strings.TrimPrefix(v.input, d.input+"/"), 10, 32)
+			if err != nil || uint32(index)+uint32(xpubGapLimit) < d.next {
+				continue
+			}
+			gap = append(gap, v)
+			for _, b := range v.balances {
+				if b.amount != nil && b.amount.Sign() > 0 {
+					held = true
+				}
+			}
+		}
+		//an address that was emptied is still used, its nonce shows it
+		if held || anyActive(ctx, gap) {
+			added := d.derive(d.next + uint32(xpubGapLimit) - 1)
+			log.Infof("Extended (%s) by %d addresses, some of the last %d were used", d.prefix, len(added), xpubGapLimit)
+			addressList = append(addressList, added...)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// the m/0'/1/2' key of BIP-32 test vector 1, and the m/0'/1/2'/2/1000000000 key derived from it
+const (
+	vectorParent = "xpub6D4BDPcP2GT577Vvch3R8wDkScZWzQzMMUm3PWbmWvVJrZwQY4VUNgqFJPMM3No2dFDFGTsxxpG5uJh7n7epu4trkrX7x7DogT5Uv6fcLW5"
+	vectorChild  = "xpub6H1LXWLaKsWFhvm6RVpEL9P4KfRZSW7abD2ttkWP3SSQvnyA8FSVqNTEcYFgJS2UaFcxupHiYkro49S8yGasTvXEYBVPamhGW6cFJodrTHy"
+)
+
+func withGapLimit(t *testing.T, limit uint) {
+	old := xpubGapLimit
+	xpubGapLimit = limit
+	t.Cleanup(func() {
+		xpubGapLimit = old
+	})
+}
+
+func TestDeriveBIP32Vector(t *testing.T) {
+	d, end, err := parseDerivation(vectorParent + "/2/{1000000000-1000000000}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := d.derive(end)
+	if len(addresses) != 1 {
+		t.Fatalf("derived %d addresses, want 1", len(addresses))
+	}
+	key, err := hdkeychain.NewKeyFromString(vectorChild)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := key.ECPubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := crypto.PubkeyToAddress(*pub.ToECDSA()); addresses[0].address != want {
+		t.Errorf("derived %s, want %s", addresses[0].address, want)
+	}
+	if addresses[0].name != vectorParent[:12]+".../2/1000000000" {
+		t.Errorf("name = %s", addresses[0].name)
+	}
+}
+
+func TestParseDerivation(t *testing.T) {
+	withGapLimit(t, 20)
+	for _, c := range []struct {
+		path        string
+		start, end  uint32
+		errContains string
+	}{
+		{path: "", start: 0, end: 19},
+		{path: "/0", start: 0, end: 19},
+		{path: "/1/{5-9}", start: 5, end: 9},
+		{path: "/{7-7}", start: 7, end: 7},
+		{path: "/0/{9-5}", errContains: "invalid range"},
+		{path: "/0/{5-}", errContains: "invalid range"},
+		{path: "/0/{a-b}", errContains: "invalid range"},
+		{path: "/0/{0-2147483648}", errContains: "invalid range"},
+		{path: "/0'/{0-1}", errContains: "hardened"},
+	} {
+		d, end, err := parseDerivation(vectorParent + c.path)
+		if c.errContains != "" {
+			if err == nil || !strings.Contains(err.Error(), c.errContains) {
+				t.Errorf("%q: err = %v, want %q", c.path, err, c.errContains)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", c.path, err)
+			continue
+		}
+		if d.next != c.start || end != c.end {
+			t.Errorf("%q: range %d-%d, want %d-%d", c.path, d.next, end, c.start, c.end)
+		}
+	}
+}
+
+func TestParseDerivationRejects(t *testing.T) {
+	withGapLimit(t, 0)
+	if _, _, err := parseDerivation(vectorParent); err == nil {
+		t.Error("no range with a gap limit of 0 was accepted")
+	}
+	//the private key of BIP-32 test vector 1 at m
+	if _, _, err := parseDerivation("xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi/{0-1}"); err == nil {
+		t.Error("private key was accepted")
+	}
+}
+
+// withActivityNode is a node where only the addresses in used have sent a transaction, none of them holding ETH
+func withActivityNode(t *testing.T, used ...common.Address) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		switch req.Method {
+		case "eth_getTransactionCount":
+			var address common.Address
+			json.Unmarshal(req.Params[0], &address)
+			resp["result"] = "0x0"
+			for _, u := range used {
+				if u == address {
+					resp["result"] = "0x1"
+				}
+			}
+		case "eth_getBalance":
+			resp["result"] = hexutil.EncodeBig(ether(0))
+		default:
+			t.Errorf("unexpected call of %s", req.Method)
+			resp["error"] = map[string]interface{}{"code": -32601, "message": "method not found"}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	oldClient, oldDerivations := client, derivations
+	client, derivations = newRPCPool([]string{server.URL}, "priority"), nil
+	t.Cleanup(func() {
+		client, derivations = oldClient, oldDerivations
+	})
+}
+
+func TestDeriveAddressesGapLimit(t *testing.T) {
+	withGapLimit(t, 3)
+	d, _, err := parseDerivation(vectorParent + "/0/{0-5}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := d.derive(5)
+
+	//unused addresses past the range aren't derived
+	withActivityNode(t)
+	if got := deriveAddresses(context.Background(), vectorParent); len(got) != 3 {
+		t.Errorf("derived %d unused addresses, want the gap limit of 3", len(got))
+	}
+
+	//a used address at index 2 extends the range by the gap limit, and nothing after it was used
+	withActivityNode(t, index[2].address)
+	got := deriveAddresses(context.Background(), vectorParent)
+	if len(got) != 6 {
+		t.Fatalf("derived %d addresses with index 2 used, want 6", len(got))
+	}
+	for i, v := range got {
+		if v.address != index[i].address || v.input != fmt.Sprintf("%s/%d", vectorParent, i) {
+			t.Errorf("address %d = %s (%s), want %s", i, v.address, v.input, index[i].address)
+		}
+	}
+	if len(derivations) != 1 || derivations[0].next != 6 {
+		t.Errorf("derivation not kept to be extended, or kept at %v", derivations)
+	}
+}
+
+func TestGroupOfExtendedKey(t *testing.T) {
+	withGapLimit(t, 2)
+	d, end, err := parseDerivation(vectorParent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := d.derive(end)
+	for i := range derived {
+		b := Balance{symbol: "ETH"}
+		b.succeeded(ether(10), 1)
+		derived[i].balances = []Balance{b}
+	}
+	other := Address{name: "other", input: "0x5555555555555555555555555555555555555555", address: common.HexToAddress("0x5555555555555555555555555555555555555555")}
+	oldPublished, oldGroups, oldNames := published.Load(), groups, groupNames
+	published.Store(&refreshSnapshot{addresses: append(derived, other)})
+	groups, groupNames = map[string][]string{"hot": {vectorParent}}, []string{"hot"}
+	t.Cleanup(func() {
+		published.Store(oldPublished)
+		groups, groupNames = oldGroups, oldNames
+	})
+
+	m := newExposition()
+	groupMetrics(m)
+	out := m.String()
+	for _, want := range []string{`crypto_group_wallets{group="hot"} 2`, `crypto_group_balance{group="hot",symbol="ETH"} 2`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %s:\n%s", want, out)
+		}
+	}
+	memberOf := walletGroups()
+	if len(memberOf) != 2 || len(memberOf[derived[1].address.Hex()]) != 1 || len(memberOf[other.address.Hex()]) != 0 {
+		t.Errorf("groups = %v, want the two derived addresses in hot", memberOf)
+	}
+}